@@ -2,11 +2,18 @@ package gateway
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/ipfs/go-fetcher"
 	"github.com/ipld/go-ipld-prime"
 )
 
+// ErrNotFound is returned, possibly wrapped, by the LinkSystems and fetchers of
+// API implementations when a block is not available. Requests failing with it
+// get a 404 Not Found response.
+var ErrNotFound = errors.New("block not found")
+
 // API defines the backing interface needed for this gateway frontend to operate.
 type API interface {
 	// NewSession requests a link system that can be used for the duration of a given request context.
@@ -21,3 +28,13 @@ type API interface {
 	// If resolution is not supported, the name argument should be returned directly.
 	Resolve(ctx context.Context, name string) (string, error)
 }
+
+// TTLResolver is implemented by APIs which know how long their name
+// resolutions stay valid, eg. from the TTL of IPNS records or DNSLink TXT
+// records. The gateway caches resolutions of the other APIs for
+// DefaultNameTTL. API decorators should implement it, see ResolveNameTTL.
+type TTLResolver interface {
+	// ResolveTTL is like Resolve, and also returns the time the resolution
+	// stays valid for.
+	ResolveTTL(ctx context.Context, name string) (string, time.Duration, error)
+}
@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+)
+
+type backendsKeyType struct{}
+
+var backendsKey backendsKeyType
+
+// BackendsOption registers named APIs, which PublicGateways entries select
+// with GatewaySpec.Backend. Requests for these gateways, matched by
+// HostnameOption, are then resolved and served by their backend only. It
+// must come before HostnameOption.
+func BackendsOption(backends map[string]API) ServeOption {
+	return func(_ API, gc *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		if err := checkBackends(gc, backends); err != nil {
+			return nil, err
+		}
+		childMux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), backendsKey, backends)
+			childMux.ServeHTTP(w, r.WithContext(ctx))
+		})
+		return childMux, nil
+	}
+}
+
+// checkBackends checks that the backends named by the PublicGateways are
+// registered.
+func checkBackends(gc *GatewayConfig, backends map[string]API) error {
+	if gc == nil {
+		return nil
+	}
+	var problems []string
+	for host, spec := range gc.PublicGateways {
+		if spec == nil || spec.Backend == "" {
+			continue
+		}
+		if _, ok := backends[spec.Backend]; !ok {
+			problems = append(problems, fmt.Sprintf("PublicGateways[%q].Backend: unknown backend %q", host, spec.Backend))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// backendFor returns the backend named by spec, if any. Gateways naming an
+// unregistered backend fail, rather than being served by another one.
+func backendFor(ctx context.Context, spec *GatewaySpec) (API, bool, error) {
+	if spec == nil || spec.Backend == "" {
+		return nil, false, nil
+	}
+	backends, _ := ctx.Value(backendsKey).(map[string]API)
+	b, ok := backends[spec.Backend]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown backend %q", spec.Backend)
+	}
+	return b, true, nil
+}
@@ -0,0 +1,134 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/multiformats/go-multihash"
+)
+
+// blockAPI serves the raw blocks of a map.
+type blockAPI map[string][]byte
+
+func (a blockAPI) NewSession(context.Context) *ipld.LinkSystem {
+	ls := lsfetcher.NewLinkSystem(a)
+	return &ls
+}
+
+func (a blockAPI) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+func (a blockAPI) Resolve(_ context.Context, name string) (string, error) {
+	return name, nil
+}
+
+func (a blockAPI) Has(_ context.Context, key string) (bool, error) {
+	_, ok := a[key]
+	return ok, nil
+}
+
+func (a blockAPI) Get(_ context.Context, key string) ([]byte, error) {
+	if data, ok := a[key]; ok {
+		return data, nil
+	}
+	return nil, ErrNotFound
+}
+
+func newBlockAPI(t *testing.T, data string) (blockAPI, cid.Cid) {
+	t.Helper()
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blockAPI{string(c.Bytes()): []byte(data)}, c
+}
+
+func TestBackendsOption(t *testing.T) {
+	tenantA, cidA := newBlockAPI(t, "tenant a")
+	tenantB, cidB := newBlockAPI(t, "tenant b")
+	shared, cidShared := newBlockAPI(t, "shared")
+
+	gc := &GatewayConfig{
+		PublicGateways: map[string]*GatewaySpec{
+			"a.example.com": {Paths: []string{"/ipfs"}, Backend: "a"},
+			"b.example.com": {Paths: []string{"/ipfs"}, UseSubdomains: true, Backend: "b"},
+			"example.com":   {Paths: []string{"/ipfs"}},
+		},
+	}
+	backends := map[string]API{"a": tenantA, "b": tenantB}
+	h, err := makeHandler(shared, gc, nil,
+		BackendsOption(backends),
+		HostnameOption(),
+		GatewayOption("/ipfs"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	get := func(host, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	for _, test := range []struct {
+		host string
+		c    cid.Cid
+		code int
+	}{
+		{"a.example.com", cidA, http.StatusOK},
+		{"a.example.com", cidB, http.StatusNotFound},
+		{"a.example.com", cidShared, http.StatusNotFound},
+		{cidB.String() + ".ipfs.b.example.com", cidB, http.StatusOK},
+		{cidA.String() + ".ipfs.b.example.com", cidA, http.StatusNotFound},
+		{"example.com", cidShared, http.StatusOK},
+		{"example.com", cidA, http.StatusNotFound},
+	} {
+		path := "/ipfs/" + test.c.String() + "?format=raw"
+		if test.host != "a.example.com" && test.host != "example.com" {
+			// subdomain gateway
+			path = "/?format=raw"
+		}
+		if code, body := get(test.host, path); code != test.code {
+			t.Errorf("%s %s: got %d %q, expected %d", test.host, test.c, code, body, test.code)
+		}
+	}
+
+	// gateways can't name unknown backends
+	gc.PublicGateways["c.example.com"] = &GatewaySpec{Paths: []string{"/ipfs"}, Backend: "c"}
+	_, err = makeHandler(shared, gc, nil, BackendsOption(backends), HostnameOption(), GatewayOption("/ipfs"))
+	if _, ok := err.(*ConfigError); !ok {
+		t.Fatalf("expected a configuration error, got %v", err)
+	}
+
+	// nor be served by another backend if the registry is missing
+	h, err = makeHandler(shared, gc, nil, HostnameOption(), GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/ipfs/%s?format=raw", cidShared), nil)
+	req.Host = "c.example.com"
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected gateways naming unknown backends to fail, got %d", rec.Code)
+	}
+}
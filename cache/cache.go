@@ -0,0 +1,161 @@
+// Package cache implements a gateway API decorator keeping recently loaded
+// blocks in memory, so that hot blocks such as the roots of popular DAGs or
+// their index.html are not loaded from the backend on every request.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	logging "github.com/ipfs/go-log"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var log = logging.Logger("gateway/cache")
+
+// DefaultMaxBlockSize is the size of the largest block cached by default.
+// Larger blocks are rare, and would evict many small ones.
+const DefaultMaxBlockSize = 1 << 20
+
+var (
+	hitsMetric      = newCacheCounter("gw_block_cache_hits_total", "The number of blocks loaded from the block cache.")
+	missesMetric    = newCacheCounter("gw_block_cache_misses_total", "The number of blocks loaded from the backend because they were not in the block cache.")
+	evictionsMetric = newCacheCounter("gw_block_cache_evictions_total", "The number of blocks evicted from the block cache to make room for others.")
+)
+
+func newCacheCounter(name, help string) prometheus.Counter {
+	counterMetric := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "http",
+		Name:      name,
+		Help:      help,
+	})
+	if err := prometheus.Register(counterMetric); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counterMetric = are.ExistingCollector.(prometheus.Counter)
+		} else {
+			log.Errorf("failed to register ipfs_http_%s: %v", name, err)
+		}
+	}
+	return counterMetric
+}
+
+// API wraps a backend API, putting a block cache shared by all sessions in
+// front of the read storage of the backend's sessions. Blocks are verified
+// against their CID before being cached.
+type API struct {
+	gateway.API
+
+	// MaxBlockSize is the size of the largest block cached.
+	MaxBlockSize int
+
+	blocks                  *lru
+	hits, misses, evictions uint64
+}
+
+var (
+	_ gateway.API         = (*API)(nil)
+	_ gateway.TTLResolver = (*API)(nil)
+)
+
+// New returns an API caching the blocks loaded from backend, up to capacity
+// bytes of them.
+func New(backend gateway.API, capacity int64) *API {
+	return &API{
+		API:          backend,
+		MaxBlockSize: DefaultMaxBlockSize,
+		blocks:       newLRU(capacity),
+	}
+}
+
+// Stats describes the usage of a cache.
+type Stats struct {
+	Hits, Misses, Evictions uint64
+	// Blocks is the number of blocks in the cache, and Size their total size.
+	Blocks int
+	Size   int64
+}
+
+// Stats returns the usage of the cache since it was created.
+func (a *API) Stats() Stats {
+	blocks, size := a.blocks.stats()
+	return Stats{
+		Hits:      atomic.LoadUint64(&a.hits),
+		Misses:    atomic.LoadUint64(&a.misses),
+		Evictions: atomic.LoadUint64(&a.evictions),
+		Blocks:    blocks,
+		Size:      size,
+	}
+}
+
+// NewSession returns a session of the backend, whose blocks are loaded from
+// the cache when present.
+func (a *API) NewSession(ctx context.Context) *ipld.LinkSystem {
+	ls := a.API.NewSession(ctx)
+	load := ls.StorageReadOpener
+	verify := !ls.TrustedStorage
+	ls.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		key := lnk.Binary()
+		if data, ok := a.blocks.get(key); ok {
+			atomic.AddUint64(&a.hits, 1)
+			hitsMetric.Inc()
+			return bytes.NewReader(data), nil
+		}
+		atomic.AddUint64(&a.misses, 1)
+		missesMetric.Inc()
+
+		r, err := load(lctx, lnk)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if verify {
+			if err := checkBlock(lnk, data); err != nil {
+				return nil, err
+			}
+		}
+		if len(data) <= a.MaxBlockSize {
+			if evicted := a.blocks.add(key, data); evicted > 0 {
+				atomic.AddUint64(&a.evictions, uint64(evicted))
+				evictionsMetric.Add(float64(evicted))
+			}
+		}
+		return bytes.NewReader(data), nil
+	}
+	// blocks are verified when they enter the cache
+	ls.TrustedStorage = true
+	return ls
+}
+
+// checkBlock checks that data hashes to the CID of lnk, so that a corrupted
+// block from one session is never served to the others.
+func checkBlock(lnk ipld.Link, data []byte) error {
+	cl, ok := lnk.(cidlink.Link)
+	if !ok {
+		return fmt.Errorf("unsupported link type %T", lnk)
+	}
+	hashed, err := cl.Cid.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !hashed.Equals(cl.Cid) {
+		return fmt.Errorf("block does not match its CID: expected %s, got %s", cl.Cid, hashed)
+	}
+	return nil
+}
+
+// ResolveTTL resolves name with the backend, keeping the TTL it returns.
+func (a *API) ResolveTTL(ctx context.Context, name string) (string, time.Duration, error) {
+	return gateway.ResolveNameTTL(ctx, a.API, name)
+}
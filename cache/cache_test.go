@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/multiformats/go-multihash"
+)
+
+// countingAPI serves the blocks of a memstore, counting the loads.
+type countingAPI struct {
+	store *memstore.Store
+	loads int32
+}
+
+func (a *countingAPI) NewSession(context.Context) *ipld.LinkSystem {
+	ls := lsfetcher.NewLinkSystem(a)
+	return &ls
+}
+
+func (a *countingAPI) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+func (a *countingAPI) Resolve(_ context.Context, name string) (string, error) {
+	return name, nil
+}
+
+func (a *countingAPI) Get(ctx context.Context, key string) ([]byte, error) {
+	atomic.AddInt32(&a.loads, 1)
+	return a.store.Get(ctx, key)
+}
+
+func (a *countingAPI) Has(ctx context.Context, key string) (bool, error) {
+	return a.store.Has(ctx, key)
+}
+
+func newCountingAPI(t *testing.T) (*countingAPI, cid.Cid) {
+	t.Helper()
+	store := &memstore.Store{Bag: map[string][]byte{}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+
+	file, size, err := builder.BuildUnixFSFile(strings.NewReader(strings.Repeat("hello world ", 100)), "size-256", &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := builder.BuildUnixFSDirectoryEntry("hello.txt", int64(size), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := builder.BuildUnixFSDirectory([]dagpb.PBLink{entry}, &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingAPI{store: store}, root.(cidlink.Link).Cid
+}
+
+func rawBlock(t *testing.T, data string) blocks.Block {
+	t.Helper()
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := blocks.NewBlockWithCid([]byte(data), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blk
+}
+
+func serve(t *testing.T, api gateway.API) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gateway.Serve(api, &gateway.GatewayConfig{}, l, gateway.GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return "http://" + s.Addrs()[0].String()
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+		return 0, ""
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestCache(t *testing.T) {
+	backend, root := newCountingAPI(t)
+	api := New(backend, 1<<20)
+	url := serve(t, api)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code, body := get(t, url+"/ipfs/"+root.String()+"/hello.txt"); code != http.StatusOK || body != strings.Repeat("hello world ", 100) {
+				t.Errorf("unexpected response %d %q", code, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	loads := atomic.LoadInt32(&backend.loads)
+	stats := api.Stats()
+	if stats.Hits == 0 || stats.Blocks != len(backend.store.Bag) {
+		t.Fatalf("expected the blocks to be cached, got %+v", stats)
+	}
+	if code, _ := get(t, url+"/ipfs/"+root.String()+"/hello.txt"); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if atomic.LoadInt32(&backend.loads) != loads {
+		t.Fatal("expected cached blocks not to be loaded from the backend")
+	}
+}
+
+func TestCacheBounds(t *testing.T) {
+	backend := &countingAPI{store: &memstore.Store{Bag: map[string][]byte{}}}
+	var blks []blocks.Block
+	for _, s := range []string{"aaaa", "bbbb", "cccc", strings.Repeat("d", 20)} {
+		blk := rawBlock(t, s)
+		backend.store.Bag[string(blk.Cid().Bytes())] = blk.RawData()
+		blks = append(blks, blk)
+	}
+	api := New(backend, 10)
+	api.MaxBlockSize = 8
+
+	load := func(blk blocks.Block) {
+		t.Helper()
+		ls := api.NewSession(context.Background())
+		_, data, err := ls.LoadPlusRaw(ipld.LinkContext{}, cidlink.Link{Cid: blk.Cid()}, basicnode.Prototype.Any)
+		if err != nil || !bytes.Equal(data, blk.RawData()) {
+			t.Fatalf("unexpected block %q (%v)", data, err)
+		}
+	}
+	load(blks[0])
+	load(blks[1])
+	load(blks[0])
+	// evicts bbbb, the least recently used
+	load(blks[2])
+	// too large
+	load(blks[3])
+
+	stats := api.Stats()
+	if stats.Hits != 1 || stats.Misses != 4 || stats.Evictions != 1 || stats.Blocks != 2 || stats.Size != 8 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if _, ok := api.blocks.get(string(blks[1].Cid().Bytes())); ok {
+		t.Fatal("expected the least recently used block to be evicted")
+	}
+}
+
+func TestCacheCorrupted(t *testing.T) {
+	backend := &countingAPI{store: &memstore.Store{Bag: map[string][]byte{}}}
+	blk := rawBlock(t, "hello")
+	backend.store.Bag[string(blk.Cid().Bytes())] = []byte("corrupted")
+	api := New(backend, 1<<20)
+
+	ls := api.NewSession(context.Background())
+	if _, err := ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: blk.Cid()}, basicnode.Prototype.Any); err == nil {
+		t.Fatal("expected the corrupted block to be rejected")
+	}
+	if stats := api.Stats(); stats.Blocks != 0 {
+		t.Fatalf("expected the corrupted block not to be cached, got %+v", stats)
+	}
+}
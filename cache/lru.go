@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru is a least recently used cache of blocks, bounded by the total size of
+// the blocks it holds. It is safe for concurrent use.
+type lru struct {
+	capacity int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // of *entry, most recently used first
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	key  string
+	data []byte
+}
+
+func newLRU(capacity int64) *lru {
+	return &lru{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *lru) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*entry).data, true
+}
+
+// add caches data under key, and returns the number of blocks evicted to
+// make room for it. Blocks larger than the capacity are not cached.
+func (c *lru) add(key string, data []byte) (evicted int) {
+	size := int64(len(data))
+	if size > c.capacity {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		// blocks are immutable, another session added it first
+		c.order.MoveToFront(e)
+		return 0
+	}
+	for c.size+size > c.capacity {
+		oldest := c.order.Back()
+		old := c.order.Remove(oldest).(*entry)
+		delete(c.entries, old.key)
+		c.size -= int64(len(old.data))
+		evicted++
+	}
+	c.entries[key] = c.order.PushFront(&entry{key: key, data: data})
+	c.size += size
+	return evicted
+}
+
+func (c *lru) stats() (blocks int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.size
+}
@@ -0,0 +1,170 @@
+// Package car implements a read-only gateway API serving the blocks of a set
+// of CARv1 or CARv2 files, such as release artifacts.
+package car
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-ipld-prime"
+)
+
+// ErrNameNotFound is returned by StaticResolver for unknown names.
+var ErrNameNotFound = errors.New("name not found")
+
+// Resolver resolves names, such as /ipns/example.com, to content paths.
+type Resolver func(ctx context.Context, name string) (string, error)
+
+// StaticResolver resolves the names of the map to their paths, eg.
+// "/ipns/dist.example.com" to "/ipfs/bafy...". Other names fail with
+// ErrNameNotFound.
+func StaticResolver(names map[string]string) Resolver {
+	return func(_ context.Context, name string) (string, error) {
+		if p, ok := names[name]; ok {
+			return p, nil
+		}
+		return "", fmt.Errorf("%w: %s", ErrNameNotFound, name)
+	}
+}
+
+// API serves the blocks of CAR files. Blocks are looked up in the indexes of
+// the CARs, in the order the files were given, and are never fetched from
+// anywhere else: missing blocks fail with gateway.ErrNotFound.
+type API struct {
+	// Resolver resolves names for the gateway. When nil, names are returned
+	// unchanged, meaning resolution is not supported.
+	Resolver Resolver
+
+	paths []string
+	cars  []*blockstore.ReadOnly
+}
+
+var _ gateway.API = (*API)(nil)
+
+// Open opens the CAR files at the given paths, indexing those which don't
+// carry an index. Directories are expanded to the *.car files they contain.
+func Open(paths ...string) (*API, error) {
+	a := &API{}
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		if !fi.IsDir() {
+			a.paths = append(a.paths, p)
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(p, "*.car"))
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		a.paths = append(a.paths, files...)
+	}
+	if len(a.paths) == 0 {
+		return nil, fmt.Errorf("no CAR files in %v", paths)
+	}
+
+	for _, p := range a.paths {
+		bs, err := blockstore.OpenReadOnly(p)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to open CAR %s: %w", p, err)
+		}
+		a.cars = append(a.cars, bs)
+	}
+	return a, nil
+}
+
+// Roots returns the roots of all the CAR files.
+func (a *API) Roots() ([]cid.Cid, error) {
+	var roots []cid.Cid
+	for i, bs := range a.cars {
+		r, err := bs.Roots()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read roots of %s: %w", a.paths[i], err)
+		}
+		roots = append(roots, r...)
+	}
+	return roots, nil
+}
+
+// Close closes all the CAR files.
+func (a *API) Close() error {
+	var firstErr error
+	for _, bs := range a.cars {
+		if err := bs.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// NewSession returns a LinkSystem reading from the CAR files.
+func (a *API) NewSession(context.Context) *ipld.LinkSystem {
+	ls := lsfetcher.NewLinkSystem(&storage{a.cars})
+	return &ls
+}
+
+// FetcherForSession returns a fetcher which loads the requested blocks from
+// the CAR files, failing if any of them is missing.
+func (a *API) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+// Resolve resolves name with the Resolver.
+func (a *API) Resolve(ctx context.Context, name string) (string, error) {
+	if a.Resolver == nil {
+		return name, nil
+	}
+	return a.Resolver(ctx, name)
+}
+
+// storage implements ipld's storage.ReadableStorage over the CAR indexes.
+type storage struct {
+	cars []*blockstore.ReadOnly
+}
+
+func (s *storage) Has(ctx context.Context, key string) (bool, error) {
+	c, err := cid.Cast([]byte(key))
+	if err != nil {
+		return false, err
+	}
+	for _, bs := range s.cars {
+		if ok, err := bs.Has(ctx, c); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (s *storage) Get(ctx context.Context, key string) ([]byte, error) {
+	c, err := cid.Cast([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	for _, bs := range s.cars {
+		ok, err := bs.Has(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return blk.RawData(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", gateway.ErrNotFound, c)
+}
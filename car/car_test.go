@@ -0,0 +1,166 @@
+package car
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+)
+
+// writeTestCAR writes a CARv2 with a UnixFS directory holding the given
+// files, and returns its root. Files named in skip are left out of the CAR.
+func writeTestCAR(t *testing.T, path string, files map[string]string, skip ...string) cid.Cid {
+	t.Helper()
+	store := &memstore.Store{Bag: map[string][]byte{}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+
+	skipped := map[string]bool{}
+	var entries []dagpb.PBLink
+	for name, content := range files {
+		lnk, size, err := builder.BuildUnixFSFile(bytes.NewReader([]byte(content)), "", &ls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), lnk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+		for _, s := range skip {
+			if s == name {
+				skipped[string(lnk.(cidlink.Link).Cid.Bytes())] = true
+			}
+		}
+	}
+	root, _, err := builder.BuildUnixFSDirectory(entries, &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCid := root.(cidlink.Link).Cid
+
+	rw, err := blockstore.OpenReadWrite(path, []cid.Cid{rootCid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range store.Bag {
+		if skipped[key] {
+			continue
+		}
+		c, err := cid.Cast([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rw.Put(context.Background(), blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	return rootCid
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestAPI(t *testing.T) {
+	dir := t.TempDir()
+	v2Root := writeTestCAR(t, filepath.Join(dir, "v2.car"), map[string]string{"a.txt": "from v2"})
+	v1Root := writeTestCAR(t, filepath.Join(dir, "tmp.carv2"), map[string]string{
+		"b.txt":   "from v1",
+		"missing": "not in the CAR",
+	}, "missing")
+	if err := carv2.ExtractV1File(filepath.Join(dir, "tmp.carv2"), filepath.Join(dir, "v1.car")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a directory, and a single file
+	api, err := Open(dir, filepath.Join(dir, "tmp.carv2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+	if roots, err := api.Roots(); err != nil || len(roots) != 3 {
+		t.Fatalf("expected the roots of 3 CARs, got %v (%v)", roots, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gateway.Serve(api, &gateway.GatewayConfig{}, l, gateway.GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	url := "http://" + s.Addrs()[0].String()
+
+	for _, test := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/ipfs/" + v2Root.String() + "/a.txt", http.StatusOK, "from v2"},
+		{"/ipfs/" + v1Root.String() + "/b.txt", http.StatusOK, "from v1"},
+		// blocks missing from the CARs
+		{"/ipfs/" + v1Root.String() + "/missing", http.StatusNotFound, ""},
+		{"/ipfs/bafkreie7q3iidccmpvszul7kudcvvuavuo7u6gzlbobczuk5nqk3b4akba", http.StatusNotFound, ""},
+		{"/ipfs/bafkreie7q3iidccmpvszul7kudcvvuavuo7u6gzlbobczuk5nqk3b4akba?format=raw", http.StatusNotFound, ""},
+		{"/ipfs/bafkreie7q3iidccmpvszul7kudcvvuavuo7u6gzlbobczuk5nqk3b4akba?format=car", http.StatusNotFound, ""},
+	} {
+		code, body := get(t, url+test.path)
+		if code != test.code || (test.body != "" && body != test.body) {
+			t.Errorf("%s: got %d %q, expected %d %q", test.path, code, body, test.code, test.body)
+		}
+	}
+
+	if _, err := Open(t.TempDir()); err == nil {
+		t.Fatal("expected an error without CAR files")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	api := &API{}
+	if p, err := api.Resolve(context.Background(), "/ipns/example.com"); err != nil || p != "/ipns/example.com" {
+		t.Fatalf("expected names to be returned unchanged without a resolver, got %q (%v)", p, err)
+	}
+
+	api.Resolver = StaticResolver(map[string]string{"/ipns/example.com": "/ipfs/bafkqaaa"})
+	if p, err := api.Resolve(context.Background(), "/ipns/example.com"); err != nil || p != "/ipfs/bafkqaaa" {
+		t.Fatalf("unexpected resolution %q (%v)", p, err)
+	}
+	if _, err := api.Resolve(context.Background(), "/ipns/other.com"); !errors.Is(err, ErrNameNotFound) {
+		t.Fatalf("expected ErrNameNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Command gateway-prime runs a read-only HTTP gateway serving the blocks of a
+// flat-file blockstore such as the blocks directory of a go-ipfs repository,
+// of a directory of CAR files, or of upstream gateways. When several are set,
+// they are tried in this order.
+//
+//	gateway-prime -car ./cars -listen :8080
+//	gateway-prime -blocks ~/.ipfs/blocks -config gateway.yaml
+//	gateway-prime -blocks ~/.ipfs/blocks -upstream https://ipfs.io
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	"github.com/ipfs-shipyard/gateway-prime/cache"
+	"github.com/ipfs-shipyard/gateway-prime/car"
+	"github.com/ipfs-shipyard/gateway-prime/coalesce"
+	"github.com/ipfs-shipyard/gateway-prime/flatfs"
+	"github.com/ipfs-shipyard/gateway-prime/multi"
+	"github.com/ipfs-shipyard/gateway-prime/remote"
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("gateway-prime")
+
+// set at build time with -ldflags "-X main.commit=..."
+var (
+	version = "gateway-prime/0.0.1"
+	commit  = ""
+)
+
+func main() {
+	if err := run(os.Args[1:]); err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "gateway-prime: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// options are the command line flags.
+type options struct {
+	configPath string
+	listen     string
+	carDir     string
+	blocksDir  string
+	upstreams  string
+	upNames    bool
+	timeout    time.Duration
+	cacheSize  int64
+	useTLS     bool
+	hostname   bool
+	metrics    string
+	versionEP  bool
+	logs       bool
+	webui      bool
+}
+
+func parseFlags(args []string) (*options, error) {
+	o := &options{}
+	fs := flag.NewFlagSet("gateway-prime", flag.ContinueOnError)
+	fs.StringVar(&o.configPath, "config", "", "gateway configuration file, in JSON (go-ipfs Gateway section) or YAML; GATEWAY_* environment variables override it")
+	fs.StringVar(&o.listen, "listen", "127.0.0.1:8080", "comma separated addresses to listen on, as host:port or multiaddrs")
+	fs.StringVar(&o.carDir, "car", "", "serve the blocks of this CAR file, or of the CAR files in this directory")
+	fs.StringVar(&o.blocksDir, "blocks", "", "serve the blocks of this flat-file blockstore, eg. ~/.ipfs/blocks")
+	fs.StringVar(&o.upstreams, "upstream", "", "comma separated URLs of trustless gateways to fetch missing blocks from, eg. https://ipfs.io")
+	fs.BoolVar(&o.upNames, "upstream-names", false, "resolve /ipns names with the upstream gateways, trusting their answers")
+	fs.DurationVar(&o.timeout, "upstream-timeout", 30*time.Second, "time after which a block load from the upstreams fails, 0 for none")
+	fs.Int64Var(&o.cacheSize, "cache", 64<<20, "size in bytes of the in-memory block cache, 0 to disable")
+	fs.BoolVar(&o.useTLS, "tls", false, "serve HTTPS with the TLSCertificates of the PublicGateways")
+	fs.BoolVar(&o.hostname, "hostname", true, "handle subdomain and DNSLink gateways (HostnameOption)")
+	fs.StringVar(&o.metrics, "metrics", "/debug/metrics/prometheus", "path of the Prometheus metrics, empty to disable")
+	fs.BoolVar(&o.versionEP, "version", true, "serve the version at /version (VersionOption)")
+	fs.BoolVar(&o.logs, "logs", false, "stream the logs at /logs (LogOption), don't expose it publicly")
+	fs.BoolVar(&o.webui, "webui", false, "redirect /webui to the IPFS web UI (WebUIOption)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if o.carDir == "" && o.blocksDir == "" && o.upstreams == "" {
+		return nil, fmt.Errorf("at least one of -blocks, -car and -upstream must be set")
+	}
+	return o, nil
+}
+
+// loadConfig loads the configuration file and environment.
+func (o *options) loadConfig() (*gateway.GatewayConfig, error) {
+	return gateway.LoadConfig(o.configPath)
+}
+
+// newAPI returns the API serving the backends set, and a function closing
+// them.
+func (o *options) newAPI() (gateway.API, func() error, error) {
+	var backends []multi.Backend
+	closeAPI := func() error { return nil }
+
+	if o.blocksDir != "" {
+		// don't create an empty blockstore on typos
+		if _, err := os.Stat(o.blocksDir); err != nil {
+			return nil, nil, err
+		}
+		store, err := flatfs.Open(o.blocksDir, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		backends = append(backends, multi.Backend{Name: "blocks", API: flatfs.New(store)})
+	}
+	if o.carDir != "" {
+		cars, err := car.Open(o.carDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		closeAPI = cars.Close
+		backends = append(backends, multi.Backend{Name: "car", API: cars})
+	}
+	if o.upstreams != "" {
+		r, err := remote.New(strings.Split(o.upstreams, ",")...)
+		if err != nil {
+			closeAPI()
+			return nil, nil, err
+		}
+		r.ResolveNames = o.upNames
+		backends = append(backends, multi.Backend{Name: "upstream", API: r, Timeout: o.timeout})
+	}
+	var api gateway.API = backends[0].API
+	if len(backends) > 1 {
+		combined, err := multi.New(backends...)
+		if err != nil {
+			closeAPI()
+			return nil, nil, err
+		}
+		api = combined
+	}
+	// concurrent requests for the same blocks share their loads
+	api = coalesce.New(api)
+	if o.cacheSize > 0 {
+		api = cache.New(api, o.cacheSize)
+	}
+	return api, closeAPI, nil
+}
+
+// serveOptions returns the options of the endpoints enabled.
+func (o *options) serveOptions() []gateway.ServeOption {
+	var opts []gateway.ServeOption
+	if o.metrics != "" {
+		opts = append(opts,
+			gateway.MetricsCollectionOption("gateway"),
+			gateway.MetricsScrapingOption(o.metrics),
+		)
+	}
+	if o.hostname {
+		opts = append(opts, gateway.HostnameOption())
+	}
+	opts = append(opts, gateway.GatewayOption("/ipfs", "/ipns"))
+	if o.versionEP {
+		opts = append(opts, gateway.VersionOption(version, commit))
+	}
+	if o.webui {
+		opts = append(opts, gateway.WebUIOption)
+	}
+	if o.logs {
+		opts = append(opts, gateway.LogOption())
+	}
+	return opts
+}
+
+func run(args []string) error {
+	o, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+	gc, err := o.loadConfig()
+	if err != nil {
+		return err
+	}
+	api, closeAPI, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+	defer closeAPI()
+
+	addrs := strings.Split(o.listen, ",")
+	listenAndServe := gateway.ListenAndServeAddrs
+	if o.useTLS {
+		listenAndServe = gateway.ListenAndServeTLSAddrs
+	}
+	s, err := listenAndServe(api, gc, addrs, o.serveOptions()...)
+	if err != nil {
+		return err
+	}
+	for _, addr := range s.Addrs() {
+		log.Infof("gateway listening on %s", addr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.ReloadOnSignal(ctx, o.loadConfig)
+	if o.configPath != "" {
+		go s.WatchConfig(ctx, 5*time.Second, o.loadConfig, o.configPath)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-s.Done():
+		return s.Err()
+	case sig := <-stop:
+		log.Infof("received %s, shutting down", sig)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelShutdown()
+	return s.Shutdown(shutdownCtx)
+}
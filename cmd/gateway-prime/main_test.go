@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	"github.com/ipfs-shipyard/gateway-prime/cache"
+	"github.com/ipfs-shipyard/gateway-prime/coalesce"
+	"github.com/ipfs-shipyard/gateway-prime/multi"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipld/go-car/v2/blockstore"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+)
+
+// writeTestCAR writes a CAR holding a UnixFS file, and returns its root.
+func writeTestCAR(t *testing.T, path, content string) cid.Cid {
+	t.Helper()
+	store := &memstore.Store{Bag: map[string][]byte{}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+	lnk, _, err := builder.BuildUnixFSFile(bytes.NewReader([]byte(content)), "", &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := lnk.(cidlink.Link).Cid
+
+	rw, err := blockstore.OpenReadWrite(path, []cid.Cid{root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range store.Bag {
+		c, err := cid.Cast([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rw.Put(context.Background(), blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestParseFlags(t *testing.T) {
+	if _, err := parseFlags(nil); err == nil {
+		t.Fatal("expected an error without backends")
+	}
+	if _, err := parseFlags([]string{"-car", "x.car", "extra"}); err == nil {
+		t.Fatal("expected an error for positional arguments")
+	}
+	if _, err := parseFlags([]string{"-h"}); err != flag.ErrHelp {
+		t.Fatalf("expected flag.ErrHelp, got %v", err)
+	}
+
+	o, err := parseFlags([]string{
+		"-config", "gateway.yaml",
+		"-listen", "127.0.0.1:0,/ip4/127.0.0.1/tcp/0",
+		"-upstream", "https://ipfs.io",
+		"-upstream-names",
+		"-upstream-timeout", "5s",
+		"-cache", "0",
+		"-hostname=false",
+		"-metrics", "",
+		"-logs",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := options{
+		configPath: "gateway.yaml",
+		listen:     "127.0.0.1:0,/ip4/127.0.0.1/tcp/0",
+		upstreams:  "https://ipfs.io",
+		upNames:    true,
+		timeout:    5 * time.Second,
+		versionEP:  true,
+		logs:       true,
+	}
+	if *o != expected {
+		t.Fatalf("unexpected options %+v", *o)
+	}
+}
+
+func TestWiring(t *testing.T) {
+	dir := t.TempDir()
+	root := writeTestCAR(t, filepath.Join(dir, "test.car"), "hello world")
+	blocksDir := filepath.Join(dir, "blocks")
+	if err := os.Mkdir(blocksDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "gateway.json")
+	if err := ioutil.WriteFile(configPath, []byte(`{"HTTPHeaders": {"X-Test": ["file"]}, "NoDNSLink": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GATEWAY_NO_DNS_LINK", "false")
+
+	o, err := parseFlags([]string{"-config", configPath, "-blocks", blocksDir, "-car", dir, "-metrics", "/metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc, err := o.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.NoDNSLink || gc.HTTPHeaders["X-Test"][0] != "file" {
+		t.Fatalf("expected the environment to override the configuration file, got %+v", gc)
+	}
+
+	// the blockstore, then the CARs, with coalesced and cached loads
+	api, closeAPI, err := o.newAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAPI()
+	cached, ok := api.(*cache.API)
+	if !ok {
+		t.Fatalf("expected a cache, got %T", api)
+	}
+	coalesced, ok := cached.API.(*coalesce.API)
+	if !ok {
+		t.Fatalf("expected coalesced loads, got %T", cached.API)
+	}
+	if _, ok := coalesced.API.(*multi.API); !ok {
+		t.Fatalf("expected several backends, got %T", coalesced.API)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gateway.Serve(api, gc, l, o.serveOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	url := "http://" + s.Addrs()[0].String()
+
+	res, err := http.Get(url + "/ipfs/" + root.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "hello world" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+	if res.Header.Get("X-Test") != "file" {
+		t.Fatal("expected the headers of the configuration file")
+	}
+	if backends := res.Header.Values(multi.BackendHeader); len(backends) == 0 || backends[len(backends)-1] != "car" {
+		t.Fatalf("expected the CAR backend to serve the file, got %v", backends)
+	}
+
+	for path, code := range map[string]int{
+		"/metrics": http.StatusOK,
+		"/version": http.StatusOK,
+		"/logs":    http.StatusNotFound,
+	} {
+		res, err := http.Get(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Errorf("%s: expected %d, got %d", path, code, res.StatusCode)
+		}
+	}
+
+	// without a cache
+	o.cacheSize = 0
+	api, closeAPI2, err := o.newAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAPI2()
+	if _, ok := api.(*coalesce.API); !ok {
+		t.Fatalf("expected no cache, got %T", api)
+	}
+
+	o.blocksDir = filepath.Join(dir, "typo")
+	if _, _, err := o.newAPI(); err == nil {
+		t.Fatal("expected missing blockstores not to be created")
+	}
+}
@@ -0,0 +1,122 @@
+// Package coalesce implements a gateway API decorator sharing backend loads
+// between sessions: when concurrent requests load the same block, such as the
+// root of a newly published DAG, the backend loads it once.
+//
+// Traversals of the same DAG by concurrent sessions share the loads of the
+// blocks they are both waiting for. Backends which fetch whole DAGs at once
+// coalesce those fetches themselves, see the remote package.
+package coalesce
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	logging "github.com/ipfs/go-log"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var log = logging.Logger("gateway/coalesce")
+
+var coalescedMetric = newCoalescedMetric()
+
+func newCoalescedMetric() prometheus.Counter {
+	counterMetric := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "http",
+		Name:      "gw_coalesced_loads_total",
+		Help:      "The number of block loads which waited for the same load of another session instead of hitting the backend.",
+	})
+	if err := prometheus.Register(counterMetric); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counterMetric = are.ExistingCollector.(prometheus.Counter)
+		} else {
+			log.Errorf("failed to register ipfs_http_gw_coalesced_loads_total: %v", err)
+		}
+	}
+	return counterMetric
+}
+
+// Router is implemented by APIs selecting the backends which load a block
+// per request, such as multi.API with routes. RouteKey identifies the
+// backends loading lnk for a request with ctx: loads are only shared between
+// sessions whose requests are routed alike.
+//
+// APIs routing requests without implementing Router must not be wrapped, as
+// a session could then be served a block loaded through another's backends.
+type Router interface {
+	RouteKey(ctx context.Context, lnk ipld.Link) string
+}
+
+// API wraps a backend API, coalescing the concurrent loads of a block by its
+// sessions into a single load from the backend.
+type API struct {
+	// first, for 64-bit alignment on 32-bit platforms
+	coalesced uint64
+
+	gateway.API
+
+	loads Group
+}
+
+var (
+	_ gateway.API         = (*API)(nil)
+	_ gateway.TTLResolver = (*API)(nil)
+)
+
+// New returns an API coalescing the block loads of backend.
+func New(backend gateway.API) *API {
+	return &API{API: backend}
+}
+
+// Coalesced returns the number of loads which shared another session's load.
+func (a *API) Coalesced() uint64 {
+	return atomic.LoadUint64(&a.coalesced)
+}
+
+// NewSession returns a session of the backend whose block loads are shared
+// with the other sessions. A load stops when ctx, or the context of the
+// load, is done, but the backend load goes on while other sessions wait for
+// it.
+func (a *API) NewSession(ctx context.Context) *ipld.LinkSystem {
+	ls := a.API.NewSession(ctx)
+	load := ls.StorageReadOpener
+	ls.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		waitCtx := lctx.Ctx
+		if waitCtx == nil {
+			waitCtx = ctx
+		}
+		key := lnk.Binary()
+		if r, ok := a.API.(Router); ok {
+			key = r.RouteKey(waitCtx, lnk) + "\x00" + key
+		}
+		v, shared, err := a.loads.Do(waitCtx, key, func(loadCtx context.Context) (interface{}, error) {
+			lctx := lctx
+			lctx.Ctx = loadCtx
+			r, err := load(lctx, lnk)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		})
+		if shared {
+			atomic.AddUint64(&a.coalesced, 1)
+			coalescedMetric.Inc()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(v.([]byte)), nil
+	}
+	return ls
+}
+
+// ResolveTTL resolves name with the backend, keeping the TTL it returns.
+func (a *API) ResolveTTL(ctx context.Context, name string) (string, time.Duration, error) {
+	return gateway.ResolveNameTTL(ctx, a.API, name)
+}
@@ -0,0 +1,138 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/multiformats/go-multihash"
+)
+
+// slowAPI serves a single block once released, counting the loads.
+type slowAPI struct {
+	block   []byte
+	release chan struct{}
+	loads   int32
+}
+
+func (a *slowAPI) NewSession(context.Context) *ipld.LinkSystem {
+	ls := lsfetcher.NewLinkSystem(a)
+	return &ls
+}
+
+func (a *slowAPI) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+func (a *slowAPI) Resolve(_ context.Context, name string) (string, error) {
+	return name, nil
+}
+
+func (a *slowAPI) Has(context.Context, string) (bool, error) {
+	return true, nil
+}
+
+func (a *slowAPI) Get(ctx context.Context, _ string) ([]byte, error) {
+	atomic.AddInt32(&a.loads, 1)
+	select {
+	case <-a.release:
+		return a.block, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestAPI(t *testing.T) {
+	backend := &slowAPI{block: []byte("hello"), release: make(chan struct{})}
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(backend.block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := New(backend)
+
+	// a session giving up doesn't fail the others
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := api.FetcherForSession(api.NewSession(ctx)).BlockOfType(ctx, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+		canceled <- err
+	}()
+	waitForWaiters(t, &api.loads, string(c.Bytes()), 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls := api.NewSession(context.Background())
+			nd, err := api.FetcherForSession(ls).BlockOfType(context.Background(), cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if b, _ := nd.AsBytes(); string(b) != "hello" {
+				t.Errorf("unexpected block %q", b)
+			}
+		}()
+	}
+	waitForWaiters(t, &api.loads, string(c.Bytes()), 11)
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the canceled session to fail, got %v", err)
+	}
+	close(backend.release)
+	wg.Wait()
+
+	if backend.loads != 1 || api.Coalesced() != 10 {
+		t.Fatalf("expected a single backend load, got %d loads and %d coalesced", backend.loads, api.Coalesced())
+	}
+}
+
+type routeKeyType struct{}
+
+// routedAPI routes the requests by the route in their context.
+type routedAPI struct {
+	*slowAPI
+}
+
+func (routedAPI) RouteKey(ctx context.Context, _ ipld.Link) string {
+	route, _ := ctx.Value(routeKeyType{}).(string)
+	return route
+}
+
+func TestAPIRouted(t *testing.T) {
+	backend := &slowAPI{block: []byte("hello"), release: make(chan struct{})}
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(backend.block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := New(routedAPI{backend})
+
+	// requests routed differently don't share their loads
+	var wg sync.WaitGroup
+	for _, route := range []string{"a", "b"} {
+		ctx := context.WithValue(context.Background(), routeKeyType{}, route)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := api.FetcherForSession(api.NewSession(ctx)).BlockOfType(ctx, cidlink.Link{Cid: c}, basicnode.Prototype.Any); err != nil {
+				t.Error(err)
+			}
+		}()
+		waitForWaiters(t, &api.loads, route+"\x00"+string(c.Bytes()), 1)
+	}
+	close(backend.release)
+	wg.Wait()
+
+	if backend.loads != 2 || api.Coalesced() != 0 {
+		t.Fatalf("expected a load per route, got %d loads and %d coalesced", backend.loads, api.Coalesced())
+	}
+}
@@ -0,0 +1,121 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters waits until n callers wait for the call for key.
+func waitForWaiters(t *testing.T, g *Group, key string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		c := g.calls[key]
+		waiters := 0
+		if c != nil {
+			waiters = c.waiters
+		}
+		g.mu.Unlock()
+		if waiters == n {
+			return
+		}
+	}
+	t.Fatalf("expected %d callers to wait for %s", n, key)
+}
+
+func TestGroup(t *testing.T) {
+	var g Group
+	var calls int32
+	release := make(chan struct{})
+	fn := func(context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "block", nil
+	}
+
+	var wg sync.WaitGroup
+	var shared int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, s, err := g.Do(context.Background(), "key", fn)
+			if err != nil || v != "block" {
+				t.Errorf("unexpected result %v (%v)", v, err)
+			}
+			if s {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	waitForWaiters(t, &g, "key", 10)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 || shared != 9 {
+		t.Fatalf("expected a single call shared by 9 callers, got %d calls and %d shared", calls, shared)
+	}
+	// calls are forgotten once done
+	if _, _, err := g.Do(context.Background(), "key", func(context.Context) (interface{}, error) {
+		return nil, errors.New("second call")
+	}); err == nil {
+		t.Fatal("expected a new call")
+	}
+}
+
+func TestGroupCancel(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-release:
+			return "block", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// the caller which started the call gives up, the other one still gets
+	// the results
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, _, err := g.Do(ctx, "key", fn)
+		first <- err
+	}()
+	waitForWaiters(t, &g, "key", 1)
+	second := make(chan interface{})
+	go func() {
+		v, _, _ := g.Do(context.Background(), "key", fn)
+		second <- v
+	}()
+	waitForWaiters(t, &g, "key", 2)
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the first caller to be canceled, got %v", err)
+	}
+	close(release)
+	if v := <-second; v != "block" {
+		t.Fatalf("expected the second caller to get the results, got %v", v)
+	}
+
+	// the call is canceled when all its callers give up
+	ctx, cancel = context.WithCancel(context.Background())
+	canceled := make(chan struct{})
+	go g.Do(ctx, "other", func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	})
+	waitForWaiters(t, &g, "other", 1)
+	cancel()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the call to be canceled")
+	}
+}
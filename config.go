@@ -1,5 +1,14 @@
 package gateway
 
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // This configuration mirrors that in go-ipfs/config/gateway.go
 
 // GatewaySpec is the specification for an individual public gateway.
@@ -21,6 +30,42 @@ type GatewaySpec struct {
 	// NoDNSLink configures this gateway to _not_ resolve DNSLink for the FQDN
 	// provided in `Host` HTTP header.
 	NoDNSLink bool
+
+	// HTTPHeaders configures headers returned by this gateway, overriding
+	// the global GatewayConfig.HTTPHeaders with the same name.
+	HTTPHeaders map[string][]string
+
+	// CORSAllowOrigins lists the origins allowed to make cross-origin
+	// requests to this gateway. The Origin of allowed requests is returned
+	// in Access-Control-Allow-Origin, and "*" allows any origin. When empty,
+	// the Access-Control-Allow-Origin header from HTTPHeaders is used,
+	// defaulting to "*".
+	CORSAllowOrigins []string
+
+	// CORSAllowMethods overrides the Access-Control-Allow-Methods header for
+	// this gateway.
+	CORSAllowMethods []string
+
+	// TLSCertificates are the certificate and key pairs to serve this
+	// gateway with when started with ServeTLS or ListenAndServeTLS. They are
+	// selected by SNI, based on the DNS names they are valid for, and
+	// reloaded when the files change.
+	//
+	// Subdomain gateways need certificates valid for *.ipfs.$gateway and
+	// *.ipns.$gateway too, either as separate pairs or as subject
+	// alternative names of a single certificate.
+	TLSCertificates []TLSCertificate
+
+	// Backend names the API serving this gateway, among the ones registered
+	// with BackendsOption, so that each tenant of a gateway is isolated in its
+	// own content store. When empty, the API passed to Serve is used.
+	Backend string
+}
+
+// TLSCertificate is a PEM encoded certificate (chain) and private key pair.
+type TLSCertificate struct {
+	CertFile string
+	KeyFile  string
 }
 
 // GatewayConfig describes the overall configuration for the gateway
@@ -64,7 +109,193 @@ type GatewayConfig struct {
 	// This flag can be overridden per FQDN in PublicGateways.
 	NoDNSLink bool
 
+	// TrustedProxies is a list of IPs or CIDRs of reverse proxies in front
+	// of the gateway. Only requests coming from these may set the host and
+	// scheme requested by the client through the Forwarded (RFC 7239),
+	// X-Forwarded-Host and X-Forwarded-Proto headers, which are ignored
+	// otherwise.
+	TrustedProxies []string
+
 	// PublicGateways configures behavior of known public gateways.
 	// Each key is a fully qualified domain name (FQDN).
 	PublicGateways map[string]*GatewaySpec
+
+	// StrictHosts makes HostnameOption reject requests for hosts which are
+	// not known gateways (PublicGateways, or the implicit localhost) with
+	// HTTP 421 Misdirected Request, instead of serving them as a path
+	// gateway. This protects against DNS rebinding, and against arbitrary
+	// domains being pointed at the gateway.
+	StrictHosts bool
+
+	// AllowedHosts are additional hosts served in StrictHosts mode, such as
+	// the IP address used by health checks. A host without a port matches
+	// any port, and a leading "*." matches any direct subdomain.
+	AllowedHosts []string
+
+	// StrictHostsDNSLink lets hosts with a DNSLink record through in
+	// StrictHosts mode, unless NoDNSLink is set.
+	StrictHostsDNSLink bool
+
+	// RequestTimeout is the maximum time a single gateway request may take,
+	// including streaming the response. Defaults to one hour.
+	RequestTimeout time.Duration
+
+	// FirstBlockTimeout is the maximum time to wait for the root block of
+	// the requested content, including the blocks loaded to resolve its
+	// path. Requests exceeding it fail fast with HTTP 504 Gateway Timeout.
+	// Zero means only RequestTimeout applies.
+	FirstBlockTimeout time.Duration
+
+	// ReadAheadBlocks is the number of blocks of a UnixFS file loaded in
+	// parallel ahead of the part being streamed, which hides the latency of
+	// remote backends. Defaults to 8, negative disables read-ahead.
+	ReadAheadBlocks int
+
+	// ResolveCacheSize is the number of resolved content paths cached. The
+	// resolutions of /ipfs paths are kept until evicted, the ones of /ipns
+	// paths expire with the TTL of their names, and are then served while
+	// being resolved again. Defaults to 4096, negative disables the cache.
+	ResolveCacheSize int
+
+	// ReadTimeout, ReadHeaderTimeout, WriteTimeout and IdleTimeout are
+	// passed to the underlying http.Server. Zero means no timeout.
+	//
+	// Note that WriteTimeout also bounds the time spent streaming large
+	// files and CARs, and should be left unset on most gateways.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// H2C enables HTTP/2 over cleartext connections, either with prior
+	// knowledge or through an HTTP/1.1 Upgrade, so that clients such as load
+	// balancers can multiplex many requests over a single connection.
+	// HTTP/1.1 clients are served as usual.
+	H2C bool
+}
+
+// ConfigError lists all the problems found in a GatewayConfig.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid gateway configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Path prefixes a GatewaySpec can serve.
+var knownGatewayPaths = map[string]bool{
+	"/ipfs": true,
+	"/ipns": true,
+	"/ipld": true,
+	"/api":  true,
+	"/p2p":  true,
+}
+
+// Validate checks the configuration, and returns a *ConfigError listing every
+// problem found, or nil if the configuration is valid.
+func (gc *GatewayConfig) Validate() error {
+	if gc == nil {
+		return &ConfigError{Problems: []string{"no configuration provided"}}
+	}
+
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// go-ipfs configs carry these as empty lists
+	if len(gc.PathPrefixes) > 0 {
+		addf("PathPrefixes: not supported, X-Ipfs-Path-Prefix was removed")
+	}
+	if len(gc.APICommands) > 0 {
+		addf("APICommands: not supported")
+	}
+	if gc.NoFetch {
+		addf("NoFetch: not supported, fetching is up to the API implementation")
+	}
+	if _, err := parseTrustedProxies(gc.TrustedProxies); err != nil {
+		addf("TrustedProxies: %s", err)
+	}
+	for i, host := range gc.AllowedHosts {
+		if strings.TrimSpace(host) == "" {
+			addf("AllowedHosts[%d]: empty host", i)
+		}
+	}
+	for name, d := range map[string]time.Duration{
+		"RequestTimeout":    gc.RequestTimeout,
+		"FirstBlockTimeout": gc.FirstBlockTimeout,
+		"ReadTimeout":       gc.ReadTimeout,
+		"ReadHeaderTimeout": gc.ReadHeaderTimeout,
+		"WriteTimeout":      gc.WriteTimeout,
+		"IdleTimeout":       gc.IdleTimeout,
+	} {
+		if d < 0 {
+			addf("%s: negative duration %s", name, d)
+		}
+	}
+
+	hostnames := make([]string, 0, len(gc.PublicGateways))
+	for hostname := range gc.PublicGateways {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		spec := gc.PublicGateways[hostname]
+		if spec == nil {
+			// removes an implicit default
+			continue
+		}
+		field := fmt.Sprintf("PublicGateways[%q]", hostname)
+
+		if hostname == "" {
+			addf("%s: empty hostname", field)
+			continue
+		}
+		if err := checkHostname(hostname); err != nil {
+			addf("%s: invalid hostname: %s", field, err)
+		}
+		if spec.UseSubdomains && net.ParseIP(strings.Trim(stripPort(hostname), "[]")) != nil {
+			addf("%s: UseSubdomains requires a domain name, not an IP address", field)
+		}
+		for i, p := range spec.Paths {
+			if !knownGatewayPaths[strings.TrimSuffix(p, "/")] {
+				addf("%s.Paths[%d]: unknown path prefix %q", field, i, p)
+			}
+		}
+		for i, pair := range spec.TLSCertificates {
+			if pair.CertFile == "" || pair.KeyFile == "" {
+				addf("%s.TLSCertificates[%d]: both CertFile and KeyFile must be set", field, i)
+			}
+		}
+	}
+
+	sort.Strings(problems)
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// checkHostname returns an error if hostname, with an optional port, is
+// neither an IP address nor a host name, whose labels may have wildcards.
+func checkHostname(hostname string) error {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host, port = hostname, ""
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return nil
+	}
+	for _, r := range host {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '-', r == '.', r == '_', r == '*':
+		default:
+			return fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/gateway-prime/mock"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := &GatewayConfig{
+		PathPrefixes:   []string{},
+		APICommands:    []string{},
+		TrustedProxies: []string{"10.0.0.0/8"},
+		PublicGateways: map[string]*GatewaySpec{
+			"localhost":     {Paths: defaultPaths, UseSubdomains: true},
+			"*.example.com": {Paths: []string{"/ipfs", "/ipns"}},
+			"127.0.0.1":     {Paths: []string{"/ipfs"}},
+			"[::1]:8080":    {Paths: []string{"/ipfs"}},
+			"dweb.link":     nil,
+		},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected a valid configuration, got %s", err)
+	}
+
+	invalid := &GatewayConfig{
+		APICommands:    []string{"cat"},
+		TrustedProxies: []string{"not-an-ip"},
+		RequestTimeout: -time.Second,
+		PublicGateways: map[string]*GatewaySpec{
+			"*(.example.com": {Paths: []string{"/ipfs"}},
+			"*.ex+ample.com": {Paths: []string{"/ipfs"}},
+			"example.org:x":  {Paths: []string{"/ipfs"}},
+			"127.0.0.1":      {Paths: []string{"/ipfs"}, UseSubdomains: true},
+			"[::1]:8080":     {Paths: []string{"/ipfs"}, UseSubdomains: true},
+			"example.net":    {Paths: []string{"/ipfs", "/foo"}},
+		},
+	}
+	err := invalid.Validate()
+	var cfgErr *ConfigError
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("expected a *ConfigError, got %v", err)
+	}
+	for _, expected := range []string{
+		"APICommands",
+		"TrustedProxies",
+		"RequestTimeout",
+		`PublicGateways["*(.example.com"]: invalid hostname: unexpected character '('`,
+		`PublicGateways["*.ex+ample.com"]: invalid hostname: unexpected character '+'`,
+		`PublicGateways["example.org:x"]: invalid hostname: invalid port "x"`,
+		`PublicGateways["127.0.0.1"]: UseSubdomains`,
+		`PublicGateways["[::1]:8080"]: UseSubdomains`,
+		`PublicGateways["example.net"].Paths[1]: unknown path prefix "/foo"`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q to be reported in %q", expected, err)
+		}
+	}
+	if len(cfgErr.Problems) != 9 {
+		t.Errorf("expected 9 problems, got %d: %q", len(cfgErr.Problems), cfgErr.Problems)
+	}
+
+	// wildcards only match their own labels
+	hosts := prepareKnownGateways(invalid.PublicGateways)
+	for host, expected := range map[string]bool{
+		"a(.example.com":   true,
+		"a.example.com":    false,
+		"a.ex+ample.com":   true,
+		"a.exxample.com":   false,
+		"a.ex+ample.com:8": true,
+	} {
+		if _, ok := isKnownHostname(host, hosts); ok != expected {
+			t.Errorf("%s: expected a match to be %t", host, expected)
+		}
+	}
+
+	if _, err := Serve(&mock.API{}, invalid, listenLocal(t)); err == nil {
+		t.Fatal("expected Serve to refuse an invalid configuration")
+	}
+	if _, err := ListenAndServe(&mock.API{}, invalid, "127.0.0.1:0"); err == nil {
+		t.Fatal("expected ListenAndServe to refuse an invalid configuration")
+	}
+}
@@ -0,0 +1,402 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigEnvPrefix is the prefix of the environment variables overriding the
+// fields of a configuration loaded with LoadConfig.
+const ConfigEnvPrefix = "GATEWAY_"
+
+// LoadConfig reads a GatewayConfig from the file at path, applies the
+// GATEWAY_* environment overrides, and validates the result.
+//
+// Files ending in .yaml or .yml are parsed as YAML, anything else as JSON.
+// The file may be either the Gateway section of a go-ipfs config, or a whole
+// go-ipfs config file, in which case only its Gateway section is read. Keys
+// are matched case-insensitively, durations may be given as strings such as
+// "30s", and unknown keys are rejected. If path is empty, the configuration
+// only comes from the environment.
+//
+// Each top-level field can be overridden by an environment variable named
+// after it, eg. GATEWAY_ROOT_REDIRECT for RootRedirect, GATEWAY_NO_DNS_LINK
+// for NoDNSLink or GATEWAY_REQUEST_TIMEOUT for RequestTimeout. Lists are
+// comma separated, and maps such as PublicGateways are given as JSON.
+//
+// LoadConfig can be used as a ConfigLoader to reload the configuration:
+//
+//	s.WatchConfig(ctx, time.Second, func() (*GatewayConfig, error) {
+//		return gateway.LoadConfig(path)
+//	}, path)
+func LoadConfig(path string) (*GatewayConfig, error) {
+	return loadConfig(path, os.Environ())
+}
+
+func loadConfig(path string, environ []string) (*GatewayConfig, error) {
+	tree := map[string]interface{}{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read configuration: %w", err)
+		}
+		tree, err = parseConfigTree(data, filepath.Ext(path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse configuration %s: %w", path, err)
+		}
+	}
+
+	gc, err := decodeConfig(tree, environ)
+	if err != nil {
+		if path != "" {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return nil, err
+	}
+	return gc, nil
+}
+
+// parseConfigTree parses a JSON or YAML document, and returns its Gateway
+// section if it is a go-ipfs config file.
+func parseConfigTree(data []byte, ext string) (map[string]interface{}, error) {
+	var doc interface{}
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		var err error
+		if doc, err = fromYAML(doc, ""); err != nil {
+			return nil, err
+		}
+	default:
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if doc == nil {
+		// empty document
+		return map[string]interface{}{}, nil
+	}
+	tree, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an object, got %s", describeValue(doc))
+	}
+	if section, ok := tree["Gateway"].(map[string]interface{}); ok {
+		return section, nil
+	}
+	return tree, nil
+}
+
+// fromYAML turns the map[interface{}]interface{} produced by the YAML decoder
+// into map[string]interface{}, like the JSON decoder.
+func fromYAML(v interface{}, path string) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: keys must be strings, got %v", pathOrRoot(path), k)
+			}
+			var err error
+			if m[key], err = fromYAML(e, fmt.Sprintf("%s[%q]", path, key)); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range v {
+			var err error
+			if v[i], err = fromYAML(e, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+var (
+	configType   = reflect.TypeOf(GatewayConfig{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// go-ipfs Gateway keys which have no equivalent here. They are accepted as
+// long as they are disabled.
+var ignoredConfigKeys = map[string]bool{
+	"Writable": true,
+}
+
+// decodeConfig checks the tree against GatewayConfig, applies the
+// environment overrides and decodes the result.
+func decodeConfig(tree map[string]interface{}, environ []string) (*GatewayConfig, error) {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	fields := make(map[string]interface{}, len(tree))
+	for key, v := range tree {
+		if ignoredConfigKeys[key] {
+			if v != nil && v != false {
+				addf("%s: not supported", key)
+			}
+			continue
+		}
+		field, ok := configField(configType, key)
+		if !ok {
+			addf("%s: unknown key", key)
+			continue
+		}
+		v, err := normalizeConfigValue(v, field.Type, field.Name)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		fields[field.Name] = v
+	}
+
+	for _, kv := range environ {
+		name, value := kv, ""
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name, value = kv[:i], kv[i+1:]
+		}
+		if !strings.HasPrefix(name, ConfigEnvPrefix) {
+			continue
+		}
+		field, ok := configEnvField(name)
+		if !ok {
+			// other programs use this prefix too, eg. GATEWAY_INTERFACE in CGI
+			continue
+		}
+		v, err := parseEnvValue(value, field.Type, name)
+		if err == nil {
+			v, err = normalizeConfigValue(v, field.Type, name)
+		}
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		fields[field.Name] = v
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, &ConfigError{Problems: problems}
+	}
+
+	// the tree now matches GatewayConfig, let encoding/json do the rest
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	gc := &GatewayConfig{}
+	if err := json.Unmarshal(data, gc); err != nil {
+		return nil, err
+	}
+	if err := gc.Validate(); err != nil {
+		return nil, err
+	}
+	return gc, nil
+}
+
+// configField finds the field of struct type t matching key, ignoring case
+// like encoding/json.
+func configField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.IsExported() && strings.EqualFold(f.Name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// configEnvField returns the GatewayConfig field overridden by the
+// environment variable name.
+func configEnvField(name string) (reflect.StructField, bool) {
+	for i := 0; i < configType.NumField(); i++ {
+		if f := configType.Field(i); ConfigEnvPrefix+envName(f.Name) == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// envName turns a field name into an environment variable name, eg.
+// NoDNSLink into NO_DNS_LINK.
+func envName(field string) string {
+	runes := []rune(field)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			acronymEnd := unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || acronymEnd {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// parseEnvValue turns the value of an environment variable into the form it
+// would have in a JSON file.
+func parseEnvValue(value string, t reflect.Type, name string) (interface{}, error) {
+	switch {
+	case t == durationType:
+		return value, nil
+	case t.Kind() == reflect.String:
+		return value, nil
+	case t.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: expected a boolean, got %q", name, value)
+		}
+		return b, nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		list := []interface{}{}
+		for _, e := range strings.Split(value, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				list = append(list, e)
+			}
+		}
+		return list, nil
+	default:
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return nil, fmt.Errorf("%s: invalid JSON: %s", name, err)
+		}
+		return v, nil
+	}
+}
+
+// normalizeConfigValue checks v, as decoded from JSON or YAML, against the Go
+// type t, and returns it in a form encoding/json can decode into t. Problems
+// are reported with the path of the offending value.
+func normalizeConfigValue(v interface{}, t reflect.Type, path string) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == durationType:
+		switch d := v.(type) {
+		case string:
+			parsed, err := time.ParseDuration(d)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid duration %q", path, d)
+			}
+			return int64(parsed), nil
+		case float64, int:
+			// nanoseconds, as encoding/json writes them
+			return d, nil
+		}
+		return nil, fmt.Errorf("%s: expected a duration, got %s", path, describeValue(v))
+
+	case t.Kind() == reflect.String:
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("%s: expected a string, got %s", path, describeValue(v))
+		}
+		return v, nil
+
+	case t.Kind() == reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return nil, fmt.Errorf("%s: expected a boolean, got %s", path, describeValue(v))
+		}
+		return v, nil
+
+	case t.Kind() == reflect.Slice:
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a list, got %s", path, describeValue(v))
+		}
+		out := make([]interface{}, len(list))
+		for i, e := range list {
+			var err error
+			if out[i], err = normalizeConfigValue(e, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case t.Kind() == reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected an object, got %s", path, describeValue(v))
+		}
+		out := make(map[string]interface{}, len(m))
+		for _, key := range sortedKeys(m) {
+			var err error
+			if out[key], err = normalizeConfigValue(m[key], t.Elem(), fmt.Sprintf("%s[%q]", path, key)); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+
+	case t.Kind() == reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected an object, got %s", path, describeValue(v))
+		}
+		out := make(map[string]interface{}, len(m))
+		for _, key := range sortedKeys(m) {
+			field, ok := configField(t, key)
+			if !ok {
+				return nil, fmt.Errorf("%s.%s: unknown key", path, key)
+			}
+			var err error
+			if out[field.Name], err = normalizeConfigValue(m[key], field.Type, path+"."+field.Name); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func describeValue(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "a list"
+	case string:
+		return strconv.Quote(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "document"
+	}
+	return path
+}
@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	expected := &GatewayConfig{
+		HTTPHeaders:    map[string][]string{"Access-Control-Allow-Origin": {"*"}},
+		RootRedirect:   "/ipfs/bafkqaaa",
+		PathPrefixes:   []string{},
+		APICommands:    []string{},
+		NoDNSLink:      true,
+		RequestTimeout: 30 * time.Second,
+		PublicGateways: map[string]*GatewaySpec{
+			"example.com": {Paths: []string{"/ipfs", "/ipns"}, UseSubdomains: true},
+			"dweb.link":   nil,
+		},
+	}
+
+	// go-ipfs config file
+	jsonPath := writeConfigFile(t, "config", `{
+		"Identity": {"PeerID": "12D3KooW"},
+		"Gateway": {
+			"HTTPHeaders": {"Access-Control-Allow-Origin": ["*"]},
+			"RootRedirect": "/ipfs/bafkqaaa",
+			"Writable": false,
+			"PathPrefixes": [],
+			"APICommands": [],
+			"NoFetch": false,
+			"NoDNSLink": true,
+			"RequestTimeout": "30s",
+			"PublicGateways": {
+				"example.com": {"Paths": ["/ipfs", "/ipns"], "UseSubdomains": true},
+				"dweb.link": null
+			}
+		}
+	}`)
+	gc, err := loadConfig(jsonPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gc, expected) {
+		t.Fatalf("unexpected JSON configuration: %+v", gc)
+	}
+
+	yamlPath := writeConfigFile(t, "gateway.yaml", `
+httpheaders:
+  Access-Control-Allow-Origin: ["*"]
+RootRedirect: /ipfs/bafkqaaa
+PathPrefixes: []
+APICommands: []
+NoDNSLink: true
+RequestTimeout: 30s
+PublicGateways:
+  example.com:
+    paths: [/ipfs, /ipns]
+    UseSubdomains: true
+  dweb.link:
+`)
+	gc, err = loadConfig(yamlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gc, expected) {
+		t.Fatalf("unexpected YAML configuration: %+v", gc)
+	}
+
+	// environment overrides
+	gc, err = loadConfig(yamlPath, []string{
+		"GATEWAY_ROOT_REDIRECT=/ipns/example.com",
+		"GATEWAY_NO_DNS_LINK=false",
+		"GATEWAY_TRUSTED_PROXIES=10.0.0.0/8, 127.0.0.1",
+		"GATEWAY_REQUEST_TIMEOUT=1m",
+		"GATEWAY_H2C=1",
+		`GATEWAY_PUBLIC_GATEWAYS={"localhost": {"Paths": ["/ipfs"]}}`,
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"PATH=/bin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.RootRedirect != "/ipns/example.com" || gc.NoDNSLink || !gc.H2C || gc.RequestTimeout != time.Minute {
+		t.Fatalf("environment was not applied: %+v", gc)
+	}
+	if !reflect.DeepEqual(gc.TrustedProxies, []string{"10.0.0.0/8", "127.0.0.1"}) {
+		t.Fatalf("unexpected TrustedProxies %q", gc.TrustedProxies)
+	}
+	if len(gc.PublicGateways) != 1 || gc.PublicGateways["localhost"] == nil {
+		t.Fatalf("unexpected PublicGateways %+v", gc.PublicGateways)
+	}
+
+	// environment only
+	gc, err = loadConfig("", []string{"GATEWAY_ROOT_REDIRECT=/ipfs/bafkqaaa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.RootRedirect != "/ipfs/bafkqaaa" {
+		t.Fatalf("unexpected RootRedirect %q", gc.RootRedirect)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		environ []string
+		errs    []string
+	}{
+		{
+			name:    "unknown.json",
+			content: `{"RootRedirect": "/", "Rootredirekt": "/", "PublicGateways": {"example.com": {"Pathz": ["/ipfs"]}}}`,
+			errs:    []string{"Rootredirekt: unknown key", `PublicGateways["example.com"].Pathz: unknown key`},
+		},
+		{
+			name:    "types.yaml",
+			content: "NoDNSLink: maybe\nPublicGateways:\n  example.com:\n    Paths: /ipfs\n",
+			errs:    []string{`NoDNSLink: expected a boolean, got "maybe"`, `PublicGateways["example.com"].Paths: expected a list`},
+		},
+		{
+			name:    "duration.json",
+			content: `{"RequestTimeout": "soon"}`,
+			errs:    []string{`RequestTimeout: invalid duration "soon"`},
+		},
+		{
+			name:    "writable.json",
+			content: `{"Writable": true}`,
+			errs:    []string{"Writable: not supported"},
+		},
+		{
+			name:    "env.json",
+			content: `{}`,
+			environ: []string{"GATEWAY_H2C=sure", "GATEWAY_REQUEST_TIMEOUT=1 hour"},
+			errs:    []string{`GATEWAY_H2C: expected a boolean, got "sure"`, `GATEWAY_REQUEST_TIMEOUT: invalid duration "1 hour"`},
+		},
+		{
+			name:    "invalid.json",
+			content: `{"PublicGateways": {"example.com": {"Paths": ["/foo"]}}}`,
+			errs:    []string{`PublicGateways["example.com"].Paths[0]: unknown path prefix "/foo"`},
+		},
+		{
+			name:    "syntax.json",
+			content: `{"RootRedirect": }`,
+			errs:    []string{"failed to parse configuration"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeConfigFile(t, test.name, test.content)
+			_, err := loadConfig(path, test.environ)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, expected := range test.errs {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected %q in error %q", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for field, expected := range map[string]string{
+		"RootRedirect":       "ROOT_REDIRECT",
+		"HTTPHeaders":        "HTTP_HEADERS",
+		"NoDNSLink":          "NO_DNS_LINK",
+		"StrictHostsDNSLink": "STRICT_HOSTS_DNS_LINK",
+		"H2C":                "H2C",
+	} {
+		if out := envName(field); out != expected {
+			t.Errorf("envName(%q): got %s, expected %s", field, out, expected)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultDenylistReason = "blocked by gateway operator"
+
+// Kinds of denylist entries, used as the label of the hits metric.
+const (
+	denylistKindCID        = "cid"
+	denylistKindDoubleHash = "double-hash"
+	denylistKindPath       = "path"
+)
+
+// Denylist is a set of content the gateway refuses to serve. It is loaded
+// from a plain text file with one entry per line, optionally followed by
+// whitespace and a human readable reason:
+//
+//	# comments and empty lines are ignored
+//	bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi   DMCA takedown
+//	/ipfs/QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn
+//	/ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi/some/dir
+//	/ipns/example.com/private
+//	//d9d295bde21f422d471a90f2a37ec53049fdf3e5fa3ee2e8f20e10003da429e7   malware
+//
+// A bare CID (or /ipfs/{cid}) blocks the content under that CID, regardless of
+// CID version or codec. A path blocks every content path it is a prefix of.
+// Entries prefixed with // are double-hashed CIDs, as published by the
+// badbits list: the hex encoded sha256 of the CIDv1 base32 string followed by
+// a slash.
+//
+// The file can be reloaded at any time with Reload, or automatically by
+// running Watch.
+type Denylist struct {
+	path string
+
+	mu       sync.RWMutex
+	cids     map[string]string // binary multihash → reason
+	hashes   map[string]string // hex sha256 of "{cidv1}/" → reason
+	prefixes []denylistPrefix
+}
+
+type denylistPrefix struct {
+	path   string
+	reason string
+}
+
+var denylistHitsMetric = newDenylistHitsMetric()
+
+func newDenylistHitsMetric() *prometheus.CounterVec {
+	counterMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ipfs",
+			Subsystem: "http",
+			Name:      "gw_denylist_hits_total",
+			Help:      "The number of requests refused because they matched the denylist.",
+		},
+		[]string{"kind"},
+	)
+	if err := prometheus.Register(counterMetric); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counterMetric = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			log.Errorf("failed to register ipfs_http_gw_denylist_hits_total: %v", err)
+		}
+	}
+	return counterMetric
+}
+
+// NewDenylist loads the denylist stored at path.
+func NewDenylist(path string) (*Denylist, error) {
+	d := &Denylist{path: path}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reload re-reads the denylist file. If the file can not be parsed, the
+// previously loaded entries are kept and an error is returned.
+func (d *Denylist) Reload() error {
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cids := make(map[string]string)
+	hashes := make(map[string]string)
+	var prefixes []denylistPrefix
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry, reason := line, defaultDenylistReason
+		if idx := strings.IndexAny(line, " \t"); idx > 0 {
+			entry = line[:idx]
+			reason = strings.TrimSpace(line[idx:])
+		}
+
+		switch {
+		case strings.HasPrefix(entry, "//"):
+			hash := strings.ToLower(entry[2:])
+			if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("%s:%d: invalid double-hashed entry %q", d.path, lineNo, entry)
+			}
+			hashes[hash] = reason
+		case strings.HasPrefix(entry, "/"):
+			p := NewPath(entry)
+			if err := p.IsValid(); err != nil {
+				return fmt.Errorf("%s:%d: invalid path %q: %w", d.path, lineNo, entry, err)
+			}
+			// a path pointing at a CID root is stored as a CID entry, so all
+			// of its encodings are matched
+			if c, rest, ok := splitIpfsPath(p.String()); ok && rest == "" {
+				cids[string(c.Hash())] = reason
+				continue
+			}
+			prefixes = append(prefixes, denylistPrefix{path: normalizeDenylistPath(p.String()), reason: reason})
+		default:
+			c, err := cid.Decode(entry)
+			if err != nil {
+				return fmt.Errorf("%s:%d: invalid CID %q: %w", d.path, lineNo, entry, err)
+			}
+			cids[string(c.Hash())] = reason
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.cids, d.hashes, d.prefixes = cids, hashes, prefixes
+	d.mu.Unlock()
+
+	log.Infow("denylist loaded", "path", d.path, "cids", len(cids), "hashes", len(hashes), "paths", len(prefixes))
+	return nil
+}
+
+// Watch reloads the denylist whenever the underlying file changes, checking
+// every interval. It blocks until ctx is done.
+func (d *Denylist) Watch(ctx context.Context, interval time.Duration) {
+	watchFiles(ctx, interval, func() {
+		if err := d.Reload(); err != nil {
+			log.Errorf("failed to reload denylist, keeping previous entries: %s", err)
+		}
+	}, d.path)
+}
+
+// checkPath returns the reason the content path is blocked, if any.
+func (d *Denylist) checkPath(contentPath string) (reason string, blocked bool) {
+	contentPath = normalizeDenylistPath(contentPath)
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if c, _, ok := splitIpfsPath(contentPath); ok {
+		if reason, ok := d.checkCidLocked(c); ok {
+			return reason, true
+		}
+	}
+	for _, p := range d.prefixes {
+		if hasPrefix(contentPath, p.path) {
+			denylistHitsMetric.WithLabelValues(denylistKindPath).Inc()
+			return p.reason, true
+		}
+	}
+	return "", false
+}
+
+// checkCids returns the reason any of the given CIDs is blocked, if any.
+func (d *Denylist) checkCids(cids ...cid.Cid) (reason string, blocked bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, c := range cids {
+		if reason, ok := d.checkCidLocked(c); ok {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+func (d *Denylist) checkCidLocked(c cid.Cid) (string, bool) {
+	if reason, ok := d.cids[string(c.Hash())]; ok {
+		denylistHitsMetric.WithLabelValues(denylistKindCID).Inc()
+		return reason, true
+	}
+	if len(d.hashes) > 0 {
+		sum := sha256.Sum256([]byte(cid.NewCidV1(c.Type(), c.Hash()).String() + "/"))
+		if reason, ok := d.hashes[hex.EncodeToString(sum[:])]; ok {
+			denylistHitsMetric.WithLabelValues(denylistKindDoubleHash).Inc()
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// splitIpfsPath extracts the root CID and the remainder from an /ipfs/ path.
+func splitIpfsPath(p string) (c cid.Cid, rest string, ok bool) {
+	if !strings.HasPrefix(p, ipfsPathPrefix) {
+		return cid.Undef, "", false
+	}
+	parts := strings.SplitN(p[len(ipfsPathPrefix):], "/", 2)
+	c, err := cid.Decode(parts[0])
+	if err != nil {
+		return cid.Undef, "", false
+	}
+	if len(parts) == 2 {
+		rest = strings.Trim(parts[1], "/")
+	}
+	return c, rest, true
+}
+
+// normalizeDenylistPath converts the root of /ipfs/ paths to CIDv1, so path
+// prefixes match regardless of the CID encoding used in the request.
+func normalizeDenylistPath(p string) string {
+	c, rest, ok := splitIpfsPath(p)
+	if !ok {
+		return p
+	}
+	normalized := ipfsPathPrefix + cid.NewCidV1(c.Type(), c.Hash()).String()
+	if rest != "" {
+		normalized += "/" + rest
+	}
+	return normalized
+}
+
+type denylistKeyType struct{}
+
+var denylistKey denylistKeyType
+
+// DenylistOption makes gateway handlers registered after it refuse to serve
+// content matching the given denylist with HTTP 410 Gone.
+func DenylistOption(d *Denylist) ServeOption {
+	return func(_ API, _ *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		childMux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), denylistKey, d)
+			childMux.ServeHTTP(w, r.WithContext(ctx))
+		})
+		return childMux, nil
+	}
+}
+
+func denylistFromContext(ctx context.Context) *Denylist {
+	d, _ := ctx.Value(denylistKey).(*Denylist)
+	return d
+}
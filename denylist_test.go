@@ -0,0 +1,153 @@
+package gateway
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs-shipyard/gateway-prime/mock"
+	"github.com/ipfs/go-cid"
+	quickbuilder "github.com/ipfs/go-unixfsnode/data/builder/quick"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+func writeDenylist(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDenylistMatching(t *testing.T) {
+	// `ipfs object new unixfs-dir`, in both CID versions
+	v0 := mustParseCid(t, "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
+	v1 := cid.NewCidV1(v0.Type(), v0.Hash())
+	hashed := mustParseCid(t, "bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4")
+	sum := sha256.Sum256([]byte(hashed.String() + "/"))
+	dir := mustParseCid(t, "QmbWqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR")
+
+	file := filepath.Join(t.TempDir(), "denylist")
+	writeDenylist(t, file,
+		"# test denylist",
+		"",
+		v0.String()+"  legal reasons",
+		"//"+hex.EncodeToString(sum[:])+"\tmalware",
+		"/ipns/example.com/private",
+		"/ipfs/"+dir.String()+"/foo/bar",
+	)
+	d, err := NewDenylist(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path    string
+		cids    []cid.Cid
+		blocked bool
+		reason  string
+	}{
+		{"/ipfs/" + v0.String(), nil, true, "legal reasons"},
+		{"/ipfs/" + v1.String() + "/sub", nil, true, "legal reasons"},
+		{"/ipfs/" + hashed.String(), []cid.Cid{hashed}, true, "malware"},
+		{"/ipns/example.com/private/secret.txt", nil, true, defaultDenylistReason},
+		{"/ipns/example.com/privateer", nil, false, ""},
+		{"/ipns/example.com/", nil, false, ""},
+		{"/ipfs/" + cid.NewCidV1(dir.Type(), dir.Hash()).String() + "/foo/bar/baz", nil, true, defaultDenylistReason},
+		{"/ipfs/" + dir.String() + "/foo", nil, false, ""},
+		{"/ipfs/bafkqaaa", []cid.Cid{mustParseCid(t, "bafkqaaa"), v1}, true, "legal reasons"},
+		{"/ipfs/bafkqaaa", []cid.Cid{mustParseCid(t, "bafkqaaa")}, false, ""},
+	} {
+		reason, blocked := d.checkPath(test.path)
+		if !blocked {
+			reason, blocked = d.checkCids(test.cids...)
+		}
+		if blocked != test.blocked || reason != test.reason {
+			t.Errorf("%s (%v): got blocked=%t reason=%q, expected blocked=%t reason=%q", test.path, test.cids, blocked, reason, test.blocked, test.reason)
+		}
+	}
+
+	// a broken update keeps previous entries
+	writeDenylist(t, file, "not-a-cid")
+	if err := d.Reload(); err == nil {
+		t.Fatal("expected an error when reloading an invalid denylist")
+	}
+	if _, blocked := d.checkPath("/ipfs/" + v0.String()); !blocked {
+		t.Fatal("expected previous entries to be kept after a failed reload")
+	}
+
+	// a valid update replaces them
+	writeDenylist(t, file, "/ipns/example.net")
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, blocked := d.checkPath("/ipfs/" + v0.String()); blocked {
+		t.Fatal("expected entry to be removed after reload")
+	}
+	if _, blocked := d.checkPath("/ipns/example.net/index.html"); !blocked {
+		t.Fatal("expected new entry to be present after reload")
+	}
+}
+
+func TestDenylistGone(t *testing.T) {
+	a := &mock.API{}
+	ls := a.NewSession(context.Background())
+	var allowed, blocked cid.Cid
+	if err := quickbuilder.Store(ls, func(b *quickbuilder.Builder) error {
+		allowed = b.NewBytesFile([]byte("fine")).Link().(cidlink.Link).Cid
+		blocked = b.NewBytesFile([]byte("nope")).Link().(cidlink.Link).Cid
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "denylist")
+	writeDenylist(t, file, blocked.String()+" test reason")
+	d, err := NewDenylist(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := makeHandler(a, &GatewayConfig{}, nil, DenylistOption(d), GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/ipfs/" + allowed.String(), http.StatusOK},
+		{"/ipfs/" + blocked.String(), http.StatusGone},
+		{"/ipfs/" + cid.NewCidV1(cid.Raw, blocked.Hash()).String(), http.StatusGone},
+	} {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: got %d, expected %d (%s)", test.path, res.StatusCode, test.status, body)
+		}
+		if test.status == http.StatusGone && !strings.Contains(string(body), "test reason") {
+			t.Errorf("%s: expected reason in body, got %q", test.path, body)
+		}
+	}
+}
+
+func mustParseCid(t *testing.T, s string) cid.Cid {
+	t.Helper()
+	c, err := cid.Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultWatchInterval is how often watched files are polled for changes
+// when no explicit interval is provided.
+const defaultWatchInterval = 10 * time.Second
+
+// watchFiles polls the given files every interval and calls onChange whenever
+// the size or modification time of any of them changes. It blocks until ctx
+// is done.
+//
+// Polling is used instead of inotify-style notifications because the files we
+// care about (denylists, certificates, configs) are commonly replaced through
+// symlink swaps (eg. Kubernetes ConfigMaps), which notifications do not
+// reliably report.
+func watchFiles(ctx context.Context, interval time.Duration, onChange func(), paths ...string) {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+
+	last := statFiles(paths)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := statFiles(paths)
+		if current != last {
+			last = current
+			onChange()
+		}
+	}
+}
+
+// statFiles returns a fingerprint of the size and modification times of the
+// given files. Missing files contribute an empty fingerprint.
+func statFiles(paths []string) string {
+	var fp []byte
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			fp = append(fp, '-')
+			continue
+		}
+		fp = append(fp, fi.ModTime().UTC().Format(time.RFC3339Nano)...)
+		fp = append(fp, '/')
+		fp = strconv.AppendInt(fp, fi.Size(), 10)
+		fp = append(fp, ';')
+	}
+	return string(fp)
+}
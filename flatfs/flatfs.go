@@ -0,0 +1,288 @@
+// Package flatfs implements a gateway API backed by an on-disk, sharded
+// flat-file block store, with the layout of go-ds-flatfs. It can serve the
+// blocks directory of a go-ipfs repository.
+package flatfs
+
+import (
+	"context"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	gocar "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+const (
+	shardingFile = "SHARDING"
+	extension    = ".data"
+	tempPrefix   = ".put-"
+)
+
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Sharding maps the key of a block, its base32 multihash, to the directory it
+// is stored in. Name identifies the function in the SHARDING file of the
+// store, eg. /repo/flatfs/shard/v1/next-to-last/2.
+type Sharding struct {
+	Name string
+	Func func(key string) string
+}
+
+// Prefix shards blocks by the first n characters of their key.
+func Prefix(n int) Sharding {
+	padding := strings.Repeat("_", n)
+	return Sharding{
+		Name: "/repo/flatfs/shard/v1/prefix/" + strconv.Itoa(n),
+		Func: func(key string) string { return (key + padding)[:n] },
+	}
+}
+
+// Suffix shards blocks by the last n characters of their key.
+func Suffix(n int) Sharding {
+	padding := strings.Repeat("_", n)
+	return Sharding{
+		Name: "/repo/flatfs/shard/v1/suffix/" + strconv.Itoa(n),
+		Func: func(key string) string { return (padding + key)[len(key):] },
+	}
+}
+
+// NextToLast shards blocks by the n characters before the last one of their
+// key. NextToLast(2) is the default of go-ipfs.
+func NextToLast(n int) Sharding {
+	padding := strings.Repeat("_", n)
+	return Sharding{
+		Name: "/repo/flatfs/shard/v1/next-to-last/" + strconv.Itoa(n),
+		Func: func(key string) string {
+			offset := len(key) - n - 1
+			if offset < 0 {
+				return padding
+			}
+			return key[offset : offset+n]
+		},
+	}
+}
+
+// ParseSharding returns the sharding function named in a SHARDING file.
+func ParseSharding(name string) (Sharding, error) {
+	parts := strings.Split(strings.TrimPrefix(name, "/repo/flatfs/shard/"), "/")
+	if len(parts) != 3 || parts[0] != "v1" {
+		return Sharding{}, fmt.Errorf("unsupported sharding function %q", name)
+	}
+	n, err := strconv.Atoi(parts[2])
+	if err != nil || n <= 0 {
+		return Sharding{}, fmt.Errorf("invalid sharding function %q", name)
+	}
+	switch parts[1] {
+	case "prefix":
+		return Prefix(n), nil
+	case "suffix":
+		return Suffix(n), nil
+	case "next-to-last":
+		return NextToLast(n), nil
+	}
+	return Sharding{}, fmt.Errorf("unsupported sharding function %q", name)
+}
+
+// Store is a flat-file block store, implementing the ipld read and write
+// storage interfaces with binary CIDs as keys. Blocks are keyed on disk by
+// multihash, like go-ipfs does. Writes are atomic, so the store can be used
+// by concurrent sessions, and by several processes.
+type Store struct {
+	dir      string
+	sharding Sharding
+
+	// Sync makes Put flush blocks to disk before returning.
+	Sync bool
+}
+
+// Open opens the store in dir, creating it if needed. The sharding function
+// is read from the SHARDING file of existing stores, and must match sharding
+// unless it is nil. New stores use sharding, or NextToLast(2) by default.
+func Open(dir string, sharding *Sharding) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, shardingFile))
+	switch {
+	case err == nil:
+		name := strings.TrimSpace(string(b))
+		if sharding != nil {
+			if sharding.Name != name {
+				return nil, fmt.Errorf("%s is sharded with %s, not %s", dir, name, sharding.Name)
+			}
+			break
+		}
+		s, err := ParseSharding(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		sharding = &s
+	case os.IsNotExist(err):
+		if sharding == nil {
+			s := NextToLast(2)
+			sharding = &s
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, shardingFile), []byte(sharding.Name+"\n"), 0o644); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return &Store{dir: dir, sharding: *sharding}, nil
+}
+
+func (s *Store) path(key string) (string, error) {
+	c, err := cid.Cast([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	name := keyEncoding.EncodeToString(c.Hash())
+	return filepath.Join(s.dir, s.sharding.Func(name), name+extension), nil
+}
+
+// Has implements ipld's storage.Storage.
+func (s *Store) Has(_ context.Context, key string) (bool, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Get implements ipld's storage.ReadableStorage. Missing blocks fail with
+// gateway.ErrNotFound.
+func (s *Store) Get(_ context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		c, _ := cid.Cast([]byte(key))
+		return nil, fmt.Errorf("%w: %s", gateway.ErrNotFound, c)
+	}
+	return b, err
+}
+
+// Put implements ipld's storage.WritableStorage. The block is written to a
+// temporary file, which is then renamed, so readers never see partial blocks.
+func (s *Store) Put(_ context.Context, key string, content []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(p); err == nil {
+		// blocks are immutable
+		return nil
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if s.Sync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// API serves the blocks of a Store. Blocks are never fetched from anywhere
+// else, and sessions write new blocks to the store.
+type API struct {
+	Store *Store
+
+	// Resolver resolves names for the gateway. When nil, names are returned
+	// unchanged, meaning resolution is not supported.
+	Resolver func(ctx context.Context, name string) (string, error)
+}
+
+var _ gateway.API = (*API)(nil)
+
+// New returns an API serving the blocks of store.
+func New(store *Store) *API {
+	return &API{Store: store}
+}
+
+// NewSession returns a LinkSystem reading from and writing to the store.
+func (a *API) NewSession(context.Context) *ipld.LinkSystem {
+	ls := lsfetcher.NewLinkSystem(a.Store)
+	ls.SetWriteStorage(a.Store)
+	return &ls
+}
+
+// FetcherForSession returns a fetcher which loads the requested blocks from
+// the store, failing if any of them is missing.
+func (a *API) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+// Resolve resolves name with the Resolver.
+func (a *API) Resolve(ctx context.Context, name string) (string, error) {
+	if a.Resolver == nil {
+		return name, nil
+	}
+	return a.Resolver(ctx, name)
+}
+
+// ImportCAR adds the blocks of a CARv1 or CARv2 stream to the store, through
+// the write storage of a session, and returns the roots of the CAR.
+func (a *API) ImportCAR(ctx context.Context, r io.Reader) ([]cid.Cid, error) {
+	br, err := gocar.NewBlockReader(r)
+	if err != nil {
+		return nil, err
+	}
+	ls := a.NewSession(ctx)
+	for {
+		// the block reader checks each block against its CID
+		blk, err := br.Next()
+		if err == io.EOF {
+			return br.Roots, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		w, commit, err := ls.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(blk.RawData()); err != nil {
+			return nil, err
+		}
+		if err := commit(cidlink.Link{Cid: blk.Cid()}); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package flatfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	gocar "github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// buildTestDAG returns the blocks of a UnixFS directory holding hello.txt,
+// and its root.
+func buildTestDAG(t *testing.T) (*memstore.Store, cid.Cid) {
+	t.Helper()
+	store := &memstore.Store{Bag: map[string][]byte{}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+
+	file, size, err := builder.BuildUnixFSFile(bytes.NewReader([]byte("hello world")), "", &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := builder.BuildUnixFSDirectoryEntry("hello.txt", int64(size), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := builder.BuildUnixFSDirectory([]dagpb.PBLink{entry}, &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, root.(cidlink.Link).Cid
+}
+
+func serveTestAPI(t *testing.T, api *API) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gateway.Serve(api, &gateway.GatewayConfig{}, l, gateway.GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return "http://" + s.Addrs()[0].String()
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestStore(t *testing.T) {
+	bag, root := buildTestDAG(t)
+	dir := t.TempDir()
+	store, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for key, data := range bag.Bag {
+		if err := store.Put(ctx, key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// go-ipfs layout: <next-to-last/2>/<base32 multihash>.data
+	name := keyEncoding.EncodeToString(root.Hash())
+	if _, err := os.Stat(filepath.Join(dir, name[len(name)-3:len(name)-1], name+".data")); err != nil {
+		t.Fatalf("expected the go-ipfs layout: %s", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, shardingFile)); err != nil || string(b) != NextToLast(2).Name+"\n" {
+		t.Fatalf("unexpected SHARDING file %q (%v)", b, err)
+	}
+
+	// nothing is left behind by writes
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), tempPrefix) {
+			return fmt.Errorf("temporary file left behind: %s", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, _ := cid.Decode("bafkreie7q3iidccmpvszul7kudcvvuavuo7u6gzlbobczuk5nqk3b4akba")
+	if has, err := store.Has(ctx, string(missing.Bytes())); has || err != nil {
+		t.Fatalf("expected the block to be missing, got %v (%v)", has, err)
+	}
+	if _, err := store.Get(ctx, string(missing.Bytes())); !errors.Is(err, gateway.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// the sharding function is read back, and must match
+	reopened, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, err := reopened.Has(ctx, string(root.Bytes())); !has || err != nil {
+		t.Fatalf("expected the root in the reopened store, got %v (%v)", has, err)
+	}
+	prefix := Prefix(2)
+	if _, err := Open(dir, &prefix); err == nil {
+		t.Fatal("expected a sharding mismatch")
+	}
+
+	url := serveTestAPI(t, New(reopened))
+	if code, body := get(t, url+"/ipfs/"+root.String()+"/hello.txt"); code != http.StatusOK || body != "hello world" {
+		t.Fatalf("unexpected response %d %q", code, body)
+	}
+	if code, _ := get(t, url+"/ipfs/"+missing.String()); code != http.StatusNotFound {
+		t.Fatalf("expected missing blocks to be 404, got %d", code)
+	}
+}
+
+func TestConcurrentPut(t *testing.T) {
+	store, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Sync = true
+	ctx := context.Background()
+
+	var blks []blocks.Block
+	for i := 0; i < 20; i++ {
+		blks = append(blks, blocks.NewBlock([]byte(fmt.Sprintf("block %d", i))))
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, blk := range blks {
+				if err := store.Put(ctx, string(blk.Cid().Bytes()), blk.RawData()); err != nil {
+					t.Error(err)
+				}
+				data, err := store.Get(ctx, string(blk.Cid().Bytes()))
+				if err != nil || !bytes.Equal(data, blk.RawData()) {
+					t.Errorf("unexpected block %q (%v)", data, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestImportCAR(t *testing.T) {
+	bag, root := buildTestDAG(t)
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(bag)
+	var car bytes.Buffer
+	if _, err := gocar.TraverseV1(context.Background(), &ls, root, selectorparse.CommonSelector_ExploreAllRecursively, &car); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := New(store)
+	roots, err := api.ImportCAR(context.Background(), &car)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0] != root {
+		t.Fatalf("unexpected roots %v", roots)
+	}
+	for key := range bag.Bag {
+		if has, _ := store.Has(context.Background(), key); !has {
+			t.Fatalf("block %q was not imported", key)
+		}
+	}
+
+	url := serveTestAPI(t, api)
+	if code, body := get(t, url+"/ipfs/"+root.String()+"/hello.txt"); code != http.StatusOK || body != "hello world" {
+		t.Fatalf("unexpected response %d %q", code, body)
+	}
+}
+
+func TestParseSharding(t *testing.T) {
+	for _, test := range []struct {
+		spec, key, out string
+	}{
+		{"/repo/flatfs/shard/v1/next-to-last/2", "CIQABCDEF", "DE"},
+		{"/repo/flatfs/shard/v1/prefix/3", "CIQABCDEF", "CIQ"},
+		{"/repo/flatfs/shard/v1/suffix/2", "CIQABCDEF", "EF"},
+		{"/repo/flatfs/shard/v1/prefix/3", "A", "A__"},
+	} {
+		shard, err := ParseSharding(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shard.Name != test.spec {
+			t.Errorf("unexpected name %s for %s", shard.Name, test.spec)
+		}
+		if out := shard.Func(test.key); out != test.out {
+			t.Errorf("%s(%s): got %s, expected %s", test.spec, test.key, out, test.out)
+		}
+	}
+	if _, err := ParseSharding("/repo/flatfs/shard/v2/prefix/2"); err == nil {
+		t.Fatal("expected unknown sharding functions to be rejected")
+	}
+}
@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type requestOriginKeyType struct{}
+
+var requestOriginKey requestOriginKeyType
+
+type origin struct {
+	host   string
+	scheme string
+}
+
+// requestOrigin returns the host and scheme ("http" or "https") the client
+// used to reach the gateway. When the request comes from one of the
+// GatewayConfig.TrustedProxies, they are taken from the Forwarded header
+// (RFC 7239), or from X-Forwarded-Host and X-Forwarded-Proto if there is no
+// Forwarded header. Forwarding headers from any other peer are ignored, so
+// clients can't spoof their origin.
+func requestOrigin(r *http.Request) (host, scheme string) {
+	o, ok := r.Context().Value(requestOriginKey).(origin)
+	if !ok {
+		// outside of makeHandler, no proxy is trusted
+		o = forwardedOrigin(r, nil)
+	}
+	return o.host, o.scheme
+}
+
+// withRequestOrigin records the origin of the request, as seen by the client,
+// in its context.
+func withRequestOrigin(r *http.Request, proxies []*net.IPNet) *http.Request {
+	ctx := context.WithValue(r.Context(), requestOriginKey, forwardedOrigin(r, proxies))
+	return r.WithContext(ctx)
+}
+
+func forwardedOrigin(r *http.Request, proxies []*net.IPNet) origin {
+	o := origin{host: r.Host, scheme: "http"}
+	if r.TLS != nil || r.URL.Scheme == "https" {
+		o.scheme = "https"
+	}
+
+	ip := net.ParseIP(stripPort(r.RemoteAddr))
+	if ip == nil || !isTrustedProxy(ip, proxies) {
+		return o
+	}
+
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		elem := outermostForwarded(parseForwarded(fwd), proxies)
+		if host := elem["host"]; host != "" {
+			o.host = host
+		}
+		if proto := strings.ToLower(elem["proto"]); proto == "http" || proto == "https" {
+			o.scheme = proto
+		}
+		return o
+	}
+
+	// Support X-Forwarded-Host and X-Forwarded-Proto if added by a reverse proxy
+	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-Host
+	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-Proto
+	if xHost := strings.TrimSpace(r.Header.Get("X-Forwarded-Host")); xHost != "" {
+		o.host = xHost
+	}
+	if xproto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); xproto == "http" || xproto == "https" {
+		o.scheme = xproto
+	}
+	return o
+}
+
+// parseForwarded parses the values of Forwarded headers into a list of
+// elements, each mapping lowercase parameter names to their unquoted value.
+// Malformed pairs are skipped.
+//
+//	Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8::1]:4711"
+func parseForwarded(values []string) []map[string]string {
+	var elems []map[string]string
+	for _, v := range values {
+		for _, e := range splitQuoted(v, ',') {
+			elem := make(map[string]string)
+			for _, pair := range splitQuoted(e, ';') {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(kv[0]))
+				if key == "" {
+					continue
+				}
+				elem[key] = unquoteForwarded(strings.TrimSpace(kv[1]))
+			}
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+// outermostForwarded returns the Forwarded element added by the outermost
+// trusted proxy. Proxies append an element describing the request they
+// received, so the last element comes from the proxy talking to us, and we
+// keep walking left as long as the element was received from another trusted
+// proxy.
+func outermostForwarded(elems []map[string]string, proxies []*net.IPNet) map[string]string {
+	for i := len(elems) - 1; i >= 0; i-- {
+		ip := forwardedNodeIP(elems[i]["for"])
+		if i == 0 || ip == nil || !isTrustedProxy(ip, proxies) {
+			return elems[i]
+		}
+	}
+	return nil
+}
+
+// forwardedNodeIP returns the IP of a Forwarded node, such as 192.0.2.43,
+// 192.0.2.43:47011 or [2001:db8:cafe::17]:4711. Obfuscated identifiers and
+// "unknown" return nil.
+func forwardedNodeIP(node string) net.IP {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.IndexByte(node, ']'); end > 0 {
+			return net.ParseIP(node[1:end])
+		}
+		return nil
+	}
+	if ip := net.ParseIP(node); ip != nil {
+		return ip
+	}
+	return net.ParseIP(stripPort(node))
+}
+
+// splitQuoted splits s around sep, ignoring separators within quoted
+// strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquoteForwarded(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	v = v[1 : len(v)-1]
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
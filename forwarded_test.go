@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs-shipyard/gateway-prime/mock"
+)
+
+func TestRequestOrigin(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		remote  string
+		headers map[string]string
+		host    string
+		scheme  string
+	}{
+		{"10.0.0.1:1234", nil, "gw.example.com", "http"},
+		{"10.0.0.1:1234", map[string]string{"X-Forwarded-Host": "dweb.link", "X-Forwarded-Proto": "https"}, "dweb.link", "https"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.17;host=dweb.link;proto=https`}, "dweb.link", "https"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `For="[2001:db8:cafe::17]:4711";Host="dweb.link:443";Proto=HTTPS`}, "dweb.link:443", "https"},
+		// Forwarded takes precedence over the X-Forwarded-* headers
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `host=dweb.link`, "X-Forwarded-Host": "ipfs.io"}, "dweb.link", "http"},
+		// chain of trusted proxies: the outermost one saw the client request
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.17;host=dweb.link;proto=https, for=10.1.1.1;host=internal;proto=http`}, "dweb.link", "https"},
+		// an untrusted client can't inject an element in front of the proxy
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for=10.9.9.9;host=evil.com, for=198.51.100.17;host=dweb.link`}, "dweb.link", "http"},
+		{"[2001:db8::1]:1234", map[string]string{"Forwarded": `for=unknown;host="dweb.link";proto=https`}, "dweb.link", "https"},
+		// quoted separators
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `for=_hidden;host="a,b;c"`}, "a,b;c", "http"},
+		{"10.0.0.1:1234", map[string]string{"Forwarded": `proto=gopher`}, "gw.example.com", "http"},
+		// untrusted peers can't spoof their origin
+		{"198.51.100.17:1234", map[string]string{"Forwarded": `host=dweb.link;proto=https`}, "gw.example.com", "http"},
+		{"198.51.100.17:1234", map[string]string{"X-Forwarded-Host": "dweb.link", "X-Forwarded-Proto": "https"}, "gw.example.com", "http"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://gw.example.com/ipfs/", nil)
+		r.RemoteAddr = test.remote
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		host, scheme := requestOrigin(withRequestOrigin(r, proxies))
+		if host != test.host || scheme != test.scheme {
+			t.Errorf("%s %v: got %s://%s, expected %s://%s", test.remote, test.headers, scheme, host, test.scheme, test.host)
+		}
+	}
+}
+
+func TestTrustedProxiesHostnameOption(t *testing.T) {
+	h, err := makeHandler(&mock.API{}, &GatewayConfig{
+		TrustedProxies: []string{"192.0.2.1"},
+		PublicGateways: map[string]*GatewaySpec{
+			"dweb.link": {Paths: defaultPaths, UseSubdomains: true},
+		},
+	}, nil, HostnameOption(), GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		remote   string
+		location string
+	}{
+		{"192.0.2.1:1234", "https://bafkqaaa.ipfs.dweb.link/"},
+		{"198.51.100.17:1234", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/ipfs/bafkqaaa", nil)
+		r.RemoteAddr = test.remote
+		r.Header.Set("Forwarded", "host=dweb.link;proto=https")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if loc := w.Header().Get("Location"); loc != test.location {
+			t.Errorf("request from %s: got Location %q, expected %q", test.remote, loc, test.location)
+		}
+	}
+
+	if _, err := makeHandler(&mock.API{}, &GatewayConfig{TrustedProxies: []string{"nope"}}, nil); err == nil {
+		t.Fatal("expected an error for invalid trusted proxies")
+	}
+}
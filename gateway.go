@@ -1,14 +1,19 @@
 package gateway
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"sort"
+	"strings"
+	"sync"
 
 	id "github.com/libp2p/go-libp2p/p2p/protocol/identify"
-	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // ServeOption registers any HTTP handlers it provides on the given mux.
@@ -39,47 +44,107 @@ func cleanHeaderSet(headers []string) []string {
 
 func GatewayOption(paths ...string) ServeOption {
 	return func(a API, cfg *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
-		headers := make(map[string][]string, len(cfg.HTTPHeaders))
-		for h, v := range cfg.HTTPHeaders {
-			headers[http.CanonicalHeaderKey(h)] = v
+		snap, err := newConfigSnapshot(cfg)
+		if err != nil {
+			return nil, err
 		}
+		var gateway http.Handler = newGatewayHandler(snap, a)
 
-		// Hard-coded headers.
-		const ACAHeadersName = "Access-Control-Allow-Headers"
-		const ACEHeadersName = "Access-Control-Expose-Headers"
-		const ACAOriginName = "Access-Control-Allow-Origin"
-		const ACAMethodsName = "Access-Control-Allow-Methods"
+		for _, p := range paths {
+			mux.Handle(p+"/", gateway)
+		}
+		return mux, nil
+	}
+}
 
-		if _, ok := headers[ACAOriginName]; !ok {
-			// Default to *all*
-			headers[ACAOriginName] = []string{"*"}
+// Hard-coded headers.
+const (
+	acaHeadersName = "Access-Control-Allow-Headers"
+	aceHeadersName = "Access-Control-Expose-Headers"
+	acaOriginName  = "Access-Control-Allow-Origin"
+	acaMethodsName = "Access-Control-Allow-Methods"
+)
+
+// userHeaders are the custom headers returned by a gateway, including the
+// CORS ones.
+type userHeaders struct {
+	headers map[string][]string
+
+	// allowOrigins, when set, replaces the Access-Control-Allow-Origin
+	// header: the Origin of each request is echoed back if it is allowed.
+	allowOrigins []string
+}
+
+// newUserHeaders merges the headers of a public gateway over the global ones
+// and fills in the CORS defaults. spec may be nil.
+func newUserHeaders(cfg *GatewayConfig, spec *GatewaySpec) userHeaders {
+	headers := make(map[string][]string, len(cfg.HTTPHeaders))
+	for h, v := range cfg.HTTPHeaders {
+		headers[http.CanonicalHeaderKey(h)] = v
+	}
+
+	var allowOrigins []string
+	if spec != nil {
+		for h, v := range spec.HTTPHeaders {
+			headers[http.CanonicalHeaderKey(h)] = v
 		}
-		if _, ok := headers[ACAMethodsName]; !ok {
-			// Default to GET
-			headers[ACAMethodsName] = []string{http.MethodGet}
+		if len(spec.CORSAllowOrigins) > 0 {
+			allowOrigins = spec.CORSAllowOrigins
+			delete(headers, acaOriginName)
 		}
+		if len(spec.CORSAllowMethods) > 0 {
+			headers[acaMethodsName] = spec.CORSAllowMethods
+		}
+	}
 
-		headers[ACAHeadersName] = cleanHeaderSet(
-			append([]string{
-				"Content-Type",
-				"User-Agent",
-				"Range",
-				"X-Requested-With",
-			}, headers[ACAHeadersName]...))
+	if _, ok := headers[acaOriginName]; !ok && allowOrigins == nil {
+		// Default to *all*
+		headers[acaOriginName] = []string{"*"}
+	}
+	if _, ok := headers[acaMethodsName]; !ok {
+		// Default to GET
+		headers[acaMethodsName] = []string{http.MethodGet}
+	}
 
-		headers[ACEHeadersName] = cleanHeaderSet(
-			append([]string{
-				"Content-Range",
-				"X-Chunked-Output",
-				"X-Stream-Output",
-			}, headers[ACEHeadersName]...))
+	headers[acaHeadersName] = cleanHeaderSet(
+		append([]string{
+			"Content-Type",
+			"User-Agent",
+			"Range",
+			"X-Requested-With",
+		}, headers[acaHeadersName]...))
 
-		var gateway http.Handler = newGatewayHandler(cfg, a)
+	headers[aceHeadersName] = cleanHeaderSet(
+		append([]string{
+			"Content-Range",
+			"X-Chunked-Output",
+			"X-Stream-Output",
+		}, headers[aceHeadersName]...))
 
-		for _, p := range paths {
-			mux.Handle(p+"/", gateway)
+	return userHeaders{headers: headers, allowOrigins: allowOrigins}
+}
+
+// write sets the headers on the response to r.
+func (h userHeaders) write(w http.ResponseWriter, r *http.Request) {
+	for k, v := range h.headers {
+		w.Header()[k] = v
+	}
+	if h.allowOrigins == nil {
+		return
+	}
+
+	// the response depends on the Origin, don't let caches mix them up
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	for _, allowed := range h.allowOrigins {
+		if allowed == "*" {
+			w.Header().Set(acaOriginName, "*")
+			return
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			w.Header().Set(acaOriginName, origin)
+			return
 		}
-		return mux, nil
 	}
 }
 
@@ -97,6 +162,22 @@ func VersionOption(UserAgentVersion, CurrentCommit string) ServeOption {
 // makeHandler turns a list of ServeOptions into a http.Handler that implements
 // all of the given options, in order.
 func makeHandler(a API, gc *GatewayConfig, l net.Listener, options ...ServeOption) (http.Handler, error) {
+	live, err := newLiveConfig(gc)
+	if err != nil {
+		return nil, err
+	}
+	h, err := makeLiveHandler(a, live, l, options...)
+	if err != nil {
+		return nil, err
+	}
+	h, _ = withH2C(h, gc)
+	return h, nil
+}
+
+// makeLiveHandler is like makeHandler, but serves each request with the
+// configuration which is live when it arrives.
+func makeLiveHandler(a API, live *liveConfig, l net.Listener, options ...ServeOption) (http.Handler, error) {
+	gc := live.load().config
 	topMux := http.NewServeMux()
 	mux := topMux
 	for _, option := range options {
@@ -114,58 +195,348 @@ func makeHandler(a API, gc *GatewayConfig, l net.Listener, options ...ServeOptio
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		topMux.ServeHTTP(w, r)
+
+		// pin the configuration for the whole request
+		snap := live.load()
+		ctx := context.WithValue(r.Context(), configSnapshotKey, snap)
+		topMux.ServeHTTP(w, withRequestOrigin(r.WithContext(ctx), snap.proxies))
 	})
 	return handler, nil
 }
 
-// ListenAndServe runs an HTTP server listening at |listeningMultiAddr| with
-// the given serve options. The address must be provided in multiaddr format.
-//
-// TODO intelligently parse address strings in other formats so long as they
-// unambiguously map to a valid multiaddr. e.g. for convenience, ":8080" should
-// map to "/ip4/0.0.0.0/tcp/8080".
-func ListenAndServe(a API, gc *GatewayConfig, listeningMultiAddr string, options ...ServeOption) (*http.Server, error) {
-	addr, err := ma.NewMultiaddr(listeningMultiAddr)
-	if err != nil {
+// withH2C wraps h to also serve HTTP/2 over cleartext connections when the
+// configuration enables it, and returns the HTTP/2 server which takes them
+// over, or nil.
+func withH2C(h http.Handler, gc *GatewayConfig) (http.Handler, *http2.Server) {
+	if !gc.H2C {
+		return h, nil
+	}
+	// h2c takes over the connection when it starts with the HTTP/2
+	// preface, which ServeMux would reject.
+	h2s := &http2.Server{IdleTimeout: gc.IdleTimeout}
+	return h2c.NewHandler(h, h2s), h2s
+}
+
+// ListenAndServe runs an HTTP server listening at |listenAddr| with the given
+// serve options. The address can be provided in multiaddr format, or as a
+// host:port pair, unix:// socket path or http:// URL which unambiguously maps
+// to a multiaddr. e.g. ":8080" maps to "/ip4/0.0.0.0/tcp/8080".
+func ListenAndServe(a API, gc *GatewayConfig, listenAddr string, options ...ServeOption) (*Server, error) {
+	return listenAndServe(a, gc, []string{listenAddr}, false, options...)
+}
+
+// ListenAndServeAddrs is like ListenAndServe, but listens at each of
+// |listenAddrs|.
+func ListenAndServeAddrs(a API, gc *GatewayConfig, listenAddrs []string, options ...ServeOption) (*Server, error) {
+	return listenAndServe(a, gc, listenAddrs, false, options...)
+}
+
+// ListenAndServeTLS is like ListenAndServe, but serves HTTPS using the
+// TLSCertificates of the PublicGateways. See ServeTLS.
+func ListenAndServeTLS(a API, gc *GatewayConfig, listenAddr string, options ...ServeOption) (*Server, error) {
+	return listenAndServe(a, gc, []string{listenAddr}, true, options...)
+}
+
+// ListenAndServeTLSAddrs is like ListenAndServeTLS, but listens at each of
+// |listenAddrs|.
+func ListenAndServeTLSAddrs(a API, gc *GatewayConfig, listenAddrs []string, options ...ServeOption) (*Server, error) {
+	return listenAndServe(a, gc, listenAddrs, true, options...)
+}
+
+func listenAndServe(a API, gc *GatewayConfig, listenAddrs []string, useTLS bool, options ...ServeOption) (*Server, error) {
+	if len(listenAddrs) == 0 {
+		return nil, fmt.Errorf("no listen address provided")
+	}
+	// don't bother listening with an invalid configuration
+	if err := gc.Validate(); err != nil {
 		return nil, err
 	}
 
-	list, err := manet.Listen(addr)
+	listeners := make([]net.Listener, 0, len(listenAddrs))
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, listenAddr := range listenAddrs {
+		addr, err := toListenMultiaddr(listenAddr)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		list, err := manet.Listen(addr)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		// we might have listened to /tcp/0 - let's see what we are listing on
+		log.Infof("gateway server listening on %s", list.Multiaddr())
+		listeners = append(listeners, manet.NetListener(list))
+	}
+
+	server, err := serve(a, gc, listeners, useTLS, options...)
 	if err != nil {
+		closeAll()
 		return nil, err
 	}
+	return server, nil
+}
 
-	// we might have listened to /tcp/0 - let's see what we are listing on
-	addr = list.Multiaddr()
-	fmt.Printf("API server listening on %s\n", addr)
+// Serve accepts incoming HTTP connections on the listener and pass them
+// to ServeOption handlers. The listener is closed when the returned Server
+// is shut down.
+func Serve(a API, gc *GatewayConfig, lis net.Listener, options ...ServeOption) (*Server, error) {
+	return serve(a, gc, []net.Listener{lis}, false, options...)
+}
 
-	return Serve(a, gc, manet.NetListener(list), options...), nil
+// ServeTLS is like Serve, but accepts HTTPS connections. The certificate
+// presented to each client is picked by SNI among the TLSCertificates of the
+// PublicGateways, and certificates are reloaded from disk when they change,
+// so they can be rotated without restarting the server.
+func ServeTLS(a API, gc *GatewayConfig, lis net.Listener, options ...ServeOption) (*Server, error) {
+	return serve(a, gc, []net.Listener{lis}, true, options...)
 }
 
-// Serve accepts incoming HTTP connections on the listener and pass them
-// to ServeOption handlers.
-func Serve(a API, gc *GatewayConfig, lis net.Listener, options ...ServeOption) *http.Server {
-	// make sure we close this no matter what.
-	//defer lis.Close()
+func serve(a API, gc *GatewayConfig, listeners []net.Listener, useTLS bool, options ...ServeOption) (*Server, error) {
+	var certs *certStore
+	if useTLS {
+		var err error
+		if certs, err = newCertStore(gc); err != nil {
+			return nil, err
+		}
+	}
 
-	handler, err := makeHandler(a, gc, lis, options...)
+	live, err := newLiveConfig(gc)
 	if err != nil {
-		return nil
+		return nil, err
 	}
+	handler, err := makeLiveHandler(a, live, listeners[0], options...)
+	if err != nil {
+		return nil, err
+	}
+	handler, h2s := withH2C(handler, gc)
 
-	server := &http.Server{
-		Addr:    lis.Addr().String(),
-		Handler: handler,
+	s := &Server{
+		config:    live,
+		listeners: listeners,
+		conns:     make(map[net.Conn]int),
+		shutdown:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	s.server = &http.Server{
+		Addr:              listeners[0].Addr().String(),
+		Handler:           s.track(handler),
+		ReadTimeout:       gc.ReadTimeout,
+		ReadHeaderTimeout: gc.ReadHeaderTimeout,
+		WriteTimeout:      gc.WriteTimeout,
+		IdleTimeout:       gc.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), serverShutdownKey, (<-chan struct{})(s.shutdown))
+		},
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, serverConnKey, c)
+		},
 	}
 
+	if certs != nil {
+		s.server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-s.done
+			cancel()
+		}()
+		go certs.watch(ctx, defaultWatchInterval)
+	}
+	if h2s != nil {
+		// shutting down s.server then asks h2c connections to go away too
+		if err := http2.ConfigureServer(s.server, h2s); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, lis := range listeners {
+		s.serving.Add(1)
+		go func(lis net.Listener) {
+			defer s.serving.Done()
+			var err error
+			if certs != nil {
+				// certificates come from TLSConfig.GetCertificate
+				err = s.server.ServeTLS(lis, "", "")
+			} else {
+				err = s.server.Serve(lis)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Errorf("serving on %s failed: %s", lis.Addr(), err)
+				s.errOnce.Do(func() { s.err = err })
+				// don't leave the server half-running
+				s.server.Close()
+			}
+		}(lis)
+	}
 	go func() {
-		//todo: pipe out error.
-		err := server.Serve(lis)
-		if err != nil {
-			log.Warnf("Serving exited: %s", err)
+		s.serving.Wait()
+		select {
+		case <-s.shutdown:
+			// Shutdown and Close mark the server as done once connections
+			// have been drained.
+		default:
+			s.finish()
 		}
 	}()
 
-	return server
+	return s, nil
+}
+
+// Server is a gateway HTTP server started with Serve or ListenAndServe.
+type Server struct {
+	server    *http.Server
+	listeners []net.Listener
+	config    *liveConfig
+
+	serving      sync.WaitGroup
+	handlers     sync.WaitGroup
+	connsMu      sync.Mutex
+	conns        map[net.Conn]int
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	done     chan struct{}
+	doneOnce sync.Once
+	errOnce  sync.Once
+	err      error
+}
+
+func (s *Server) finish() {
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+// track counts the requests being handled, along with their connections.
+// h2c connections are hijacked from the http.Server, which then neither waits
+// for nor closes them, so Shutdown and Close rely on these instead. Each h2c
+// connection is a single request here, lasting as long as the connection.
+func (s *Server) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handlers.Add(1)
+		defer s.handlers.Done()
+
+		c, _ := r.Context().Value(serverConnKey).(net.Conn)
+		s.connsMu.Lock()
+		s.conns[c]++
+		s.connsMu.Unlock()
+		defer func() {
+			s.connsMu.Lock()
+			if s.conns[c]--; s.conns[c] == 0 {
+				delete(s.conns, c)
+			}
+			s.connsMu.Unlock()
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// waitHandlers waits for the requests being handled to finish, or for ctx to
+// expire.
+func (s *Server) waitHandlers(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeConns closes the connections of the requests being handled.
+func (s *Server) closeConns() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for c := range s.conns {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+// Addrs returns the addresses the server is listening on.
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// Done returns a channel which is closed once the server stopped serving,
+// either because it was shut down or because a listener failed.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error which caused the server to stop serving, if any. It
+// returns nil while the server is running and after a clean shutdown.
+func (s *Server) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting connections,
+// asks long running streams such as CAR exports to end early, and waits for
+// in-flight requests to finish. If ctx expires first, remaining connections
+// are closed forcefully and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+
+	err := s.server.Shutdown(ctx)
+	if err == nil {
+		// the http.Server asked h2c connections to go away, but does not
+		// wait for them
+		err = s.waitHandlers(ctx)
+	}
+	if err != nil {
+		s.server.Close()
+		s.closeConns()
+	}
+	s.serving.Wait()
+	s.finish()
+	return err
+}
+
+// Close immediately closes all listeners and connections.
+func (s *Server) Close() error {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+
+	err := s.server.Close()
+	s.closeConns()
+	s.serving.Wait()
+	s.finish()
+	return err
+}
+
+type serverShutdownKeyType struct{}
+
+var serverShutdownKey serverShutdownKeyType
+
+type serverConnKeyType struct{}
+
+var serverConnKey serverConnKeyType
+
+// serverShutdown returns a channel which is closed when the server handling
+// the request is shutting down. Handlers streaming long responses should stop
+// early when it is closed. The channel is nil, and thus never ready, outside
+// of a Server.
+func serverShutdown(ctx context.Context) <-chan struct{} {
+	ch, _ := ctx.Value(serverShutdownKey).(<-chan struct{})
+	return ch
 }
@@ -2,6 +2,7 @@ package gateway
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -17,14 +18,11 @@ import (
 	"time"
 
 	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-fetcher"
 	logging "github.com/ipfs/go-log"
 	resolver "github.com/ipfs/go-path/resolver"
-	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
-	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -35,6 +33,9 @@ const (
 	ipfsPathPrefix        = "/ipfs/"
 	ipnsPathPrefix        = "/ipns/"
 	immutableCacheControl = "public, max-age=29030400, immutable"
+
+	// the hour is a hard fallback, we don't expect it to happen, but just in case
+	defaultRequestTimeout = time.Hour
 )
 
 var (
@@ -67,9 +68,14 @@ type redirectTemplateData struct {
 // gatewayHandler is a HTTP handler that serves IPFS objects (accessible by default at /ipfs/<path>)
 // (it serves requests like GET /ipfs/QmVRzPKPzNtSrEzBFm2UZfxmPAgnaLke4DMcerbsGGSaFe/link)
 type gatewayHandler struct {
-	config *GatewayConfig
+	config *configSnapshot // used when the request does not carry one
 	api    API
 
+	// resolutions caches the resolved content paths, nil if disabled
+	resolutions *resolveCache
+	// backend names the backend api is, for the gateways having their own
+	backend string
+
 	// generic metrics
 	firstContentBlockGetMetric *prometheus.HistogramVec
 	unixfsGetMetric            *prometheus.SummaryVec // deprecated, use firstContentBlockGetMetric
@@ -79,6 +85,10 @@ type gatewayHandler struct {
 	unixfsGenDirGetMetric *prometheus.HistogramVec
 	carStreamGetMetric    *prometheus.HistogramVec
 	rawBlockGetMetric     *prometheus.HistogramVec
+
+	// resolution cache metrics
+	resolveCacheHitMetric  *prometheus.CounterVec
+	resolveCacheMissMetric *prometheus.CounterVec
 }
 
 // StatusResponseWriter enables us to override HTTP Status Code passed to
@@ -188,6 +198,26 @@ func newGatewaySummaryMetric(name string, help string) *prometheus.SummaryVec {
 	return summaryMetric
 }
 
+func newGatewayCounterMetric(name string, help string) *prometheus.CounterVec {
+	counterMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ipfs",
+			Subsystem: "http",
+			Name:      name,
+			Help:      help,
+		},
+		[]string{"gateway"},
+	)
+	if err := prometheus.Register(counterMetric); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counterMetric = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			log.Errorf("failed to register ipfs_http_%s: %v", name, err)
+		}
+	}
+	return counterMetric
+}
+
 func newGatewayHistogramMetric(name string, help string) *prometheus.HistogramVec {
 	// We can add buckets as a parameter in the future, but for now using static defaults
 	// suggested in https://github.com/ipfs/go-ipfs/issues/8441
@@ -212,10 +242,11 @@ func newGatewayHistogramMetric(name string, help string) *prometheus.HistogramVe
 	return histogramMetric
 }
 
-func newGatewayHandler(c *GatewayConfig, api API) *gatewayHandler {
+func newGatewayHandler(c *configSnapshot, api API) *gatewayHandler {
 	i := &gatewayHandler{
-		config: c,
-		api:    api,
+		config:      c,
+		api:         api,
+		resolutions: newResolveCache(c.config.ResolveCacheSize),
 		// Improved Metrics
 		// ----------------------------
 		// Time till the first content block (bar in /ipfs/cid/foo/bar)
@@ -248,6 +279,17 @@ func newGatewayHandler(c *GatewayConfig, api API) *gatewayHandler {
 			"The time to GET an entire raw Block from the gateway.",
 		),
 
+		// Resolution cache: content paths resolved from the cache, possibly
+		// stale, or resolved again
+		resolveCacheHitMetric: newGatewayCounterMetric(
+			"gw_resolve_cache_hits_total",
+			"The number of content paths served with a cached resolution.",
+		),
+		resolveCacheMissMetric: newGatewayCounterMetric(
+			"gw_resolve_cache_misses_total",
+			"The number of content paths resolved for lack of a cached resolution.",
+		),
+
 		// Legacy Metrics
 		// ----------------------------
 		unixfsGetMetric: newGatewaySummaryMetric( // TODO: remove?
@@ -282,10 +324,27 @@ func parseIpfsPath(p string) (cid.Cid, string, error) {
 */
 
 func (i *gatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// the hour is a hard fallback, we don't expect it to happen, but just in case
-	ctx, cancel := context.WithTimeout(r.Context(), time.Hour)
+	timeout := i.configFor(r).RequestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
 	defer cancel()
 	r = r.WithContext(ctx)
+	w, r = withResponseHeaders(w, r)
+
+	// the PublicGateways entry matched by HostnameOption may have its own
+	// backend
+	spec, _ := r.Context().Value(gatewaySpecKey).(*GatewaySpec)
+	if api, ok, err := backendFor(r.Context(), spec); err != nil {
+		webError(w, "failed to select the gateway backend", err, http.StatusInternalServerError)
+		return
+	} else if ok {
+		tenant := *i
+		tenant.api = api
+		tenant.backend = spec.Backend
+		i = &tenant
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -319,7 +378,7 @@ func (i *gatewayHandler) optionsHandler(w http.ResponseWriter, r *http.Request)
 		if server accepts cross-site XMLHttpRequest (indicated by the presence of CORS headers)
 		https://developer.mozilla.org/en-US/docs/Web/HTTP/Access_control_CORS#Preflighted_requests
 	*/
-	i.addUserHeaders(w) // return all custom headers (including CORS ones, if set)
+	i.addUserHeaders(w, r) // return all custom headers (including CORS ones, if set)
 }
 
 func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request) {
@@ -346,17 +405,34 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 	if requestHandled := handleSuperfluousNamespace(w, r, contentPath); requestHandled {
 		return
 	}
+	r = r.WithContext(context.WithValue(r.Context(), contentPathKey, contentPath))
+
+	denylist := denylistFromContext(r.Context())
+	if err := i.handleDenylistedPath(denylist, contentPath); err != nil {
+		webRequestError(w, err)
+		return
+	}
+
+	// Resolving the path and getting its root block share the first block
+	// deadline, since both load blocks
+	firstBlockCtx, cancelFirstBlock := i.firstBlockContext(r)
+	defer cancelFirstBlock()
 
 	// Resolve path to the final DAG node for the ETag
-	resolvedPath, err := ResolvePath(r.Context(), i.api, contentPath)
+	resolvedPath, err := i.resolvePath(r.WithContext(firstBlockCtx), contentPath)
 	switch err {
 	case nil:
 	//case coreiface.ErrOffline:
 	//	webError(w, "ipfs resolve -r "+debugStr(contentPath.String()), err, http.StatusServiceUnavailable)
 	//	return
 	default:
+		if err := i.firstBlockTimedOut(firstBlockCtx, r, "ipfs resolve -r "+debugStr(contentPath.String())); err != nil {
+			webRequestError(w, err)
+			return
+		}
+
 		// if Accept is text/html, see if ipfs-404.html is present
-		if i.servePretty404IfPresent(w, r, contentPath) {
+		if i.servePretty404IfPresent(w, r, contentPath, begin) {
 			logger.Debugw("serve pretty 404 if present")
 			return
 		}
@@ -365,6 +441,11 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if err := i.handleDenylistedCids(r, denylist, contentPath, resolvedPath); err != nil {
+		webRequestError(w, err)
+		return
+	}
+
 	// Detect when explicit Accept header or ?format parameter are present
 	responseFormat, formatParams, err := customResponseFormat(r)
 	if err != nil {
@@ -388,21 +469,28 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 		}
 	}
 
-	if err := i.handleGettingFirstBlock(r, begin, contentPath, resolvedPath); err != nil {
-		webRequestError(w, err)
+	firstBlock, reqErr := i.handleGettingFirstBlock(firstBlockCtx, r, begin, contentPath, resolvedPath)
+	if reqErr != nil {
+		webRequestError(w, reqErr)
 		return
 	}
 
-	if err := i.setCommonHeaders(w, r, contentPath); err != nil {
+	if err := i.setCommonHeaders(w, r, contentPath, resolvedPath); err != nil {
 		webRequestError(w, err)
 		return
 	}
 
+	// UnixFS directories record the time to the first block of their
+	// index.html instead, if they have one
+	if responseFormat != "" {
+		i.observeFirstBlock(contentPath, firstBlock)
+	}
+
 	// Support custom response formats passed via ?format or Accept HTTP header
 	switch responseFormat {
 	case "": // The implicit response format is UnixFS
 		logger.Debugw("serving unixfs", "path", contentPath)
-		i.serveUnixFS(r.Context(), w, r, resolvedPath, contentPath, begin, logger)
+		i.serveUnixFS(r.Context(), w, r, resolvedPath, contentPath, begin, firstBlock, logger)
 		return
 	case "application/vnd.ipld.raw":
 		logger.Debugw("serving raw block", "path", contentPath)
@@ -420,22 +508,19 @@ func (i *gatewayHandler) getOrHeadHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
-func (i *gatewayHandler) servePretty404IfPresent(w http.ResponseWriter, r *http.Request, contentPath Path) bool {
+func (i *gatewayHandler) servePretty404IfPresent(w http.ResponseWriter, r *http.Request, contentPath Path, begin time.Time) bool {
 	resolved404Path, ctype, err := i.searchUpTreeFor404(r, contentPath)
 	if err != nil {
 		return false
 	}
 
-	ls := i.api.NewSession(r.Context())
-	f := i.api.FetcherForSession(ls)
-	sel := selectorparse.CommonSelector_ExploreAllRecursively
-	if err := f.NodeMatching(r.Context(), basicnode.NewLink(cidlink.Link{Cid: resolved404Path.Cid()}), sel, func(result fetcher.FetchResult) error { return nil }); err != nil {
-		return false
-	}
-	file, err := ls.Load(ipld.LinkContext{Ctx: r.Context()}, cidlink.Link{Cid: resolved404Path.Cid()}, basicnode.Prototype.Any)
+	// the blocks of the 404 page are loaded as it is streamed
+	file, err := i.loadFile(r.Context(), r, cidlink.Link{Cid: resolved404Path.Cid()})
 	if err != nil {
 		return false
 	}
+	// the content path didn't resolve, this is the first block served
+	i.observeFirstBlock(contentPath, time.Since(begin))
 
 	byteReader, ok := file.(datamodel.LargeBytesNode)
 	if ok {
@@ -468,10 +553,16 @@ func (i *gatewayHandler) servePretty404IfPresent(w http.ResponseWriter, r *http.
 	return err == nil
 }
 
-func (i *gatewayHandler) addUserHeaders(w http.ResponseWriter) {
-	for k, v := range i.config.HTTPHeaders {
-		w.Header()[k] = v
-	}
+// configFor returns the configuration the request is served with.
+func (i *gatewayHandler) configFor(r *http.Request) *GatewayConfig {
+	return configSnapshotFor(r, i.config).config
+}
+
+// addUserHeaders sets the custom headers of the gateway, using the ones of
+// the PublicGateways entry matched by HostnameOption, if any.
+func (i *gatewayHandler) addUserHeaders(w http.ResponseWriter, r *http.Request) {
+	spec, _ := r.Context().Value(gatewaySpecKey).(*GatewaySpec)
+	configSnapshotFor(r, i.config).userHeadersFor(spec).write(w, r)
 }
 
 func addCacheControlHeaders(w http.ResponseWriter, r *http.Request, contentPath Path, fileCid cid.Cid) (modtime time.Time) {
@@ -535,7 +626,7 @@ func setContentDispositionHeader(w http.ResponseWriter, filename string, disposi
 }
 
 // Set X-Ipfs-Roots with logical CID array for efficient HTTP cache invalidation.
-func (i *gatewayHandler) buildIpfsRootsHeader(contentPath string, r *http.Request) (string, error) {
+func (i *gatewayHandler) buildIpfsRootsHeader(contentPath string, resolvedPath Resolved, r *http.Request) (string, error) {
 	/*
 		These are logical roots where each CID represent one path segment
 		and resolves to either a directory or the root block of a file.
@@ -554,8 +645,28 @@ func (i *gatewayHandler) buildIpfsRootsHeader(contentPath string, r *http.Reques
 		Note that while the top one will change every time any article is changed,
 		the last root (responsible for specific article) may not change at all.
 	*/
+	roots, err := i.resolveIpfsRoots(r.Context(), contentPath, resolvedPath)
+	if err != nil {
+		return "", err
+	}
+	pathRoots := make([]string, 0, len(roots))
+	for _, root := range roots {
+		pathRoots = append(pathRoots, root.String())
+	}
+	rootCidList := strings.Join(pathRoots, ",") // convention from rfc2616#sec4.2
+	return rootCidList, nil
+}
+
+// resolveIpfsRoots returns the CID of every segment of the content path, in
+// order. See buildIpfsRootsHeader. They are the ones recorded when resolving
+// the path, unless the API didn't record them.
+func (i *gatewayHandler) resolveIpfsRoots(ctx context.Context, contentPath string, resolvedPath Resolved) ([]cid.Cid, error) {
+	if roots := resolvedPath.Segments(); roots != nil {
+		return roots, nil
+	}
+
 	var sp strings.Builder
-	var pathRoots []string
+	var pathRoots []cid.Cid
 	pathSegments := strings.Split(contentPath[6:], "/")
 	sp.WriteString(contentPath[:5]) // /ipfs or /ipns
 	for _, root := range pathSegments {
@@ -564,14 +675,13 @@ func (i *gatewayHandler) buildIpfsRootsHeader(contentPath string, r *http.Reques
 		}
 		sp.WriteString("/")
 		sp.WriteString(root)
-		resolvedSubPath, err := ResolvePath(r.Context(), i.api, NewPath(sp.String()))
+		resolvedSubPath, err := ResolvePath(ctx, i.api, NewPath(sp.String()))
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		pathRoots = append(pathRoots, resolvedSubPath.Cid().String())
+		pathRoots = append(pathRoots, resolvedSubPath.Cid())
 	}
-	rootCidList := strings.Join(pathRoots, ",") // convention from rfc2616#sec4.2
-	return rootCidList, nil
+	return pathRoots, nil
 }
 
 func webRequestError(w http.ResponseWriter, err *requestError) {
@@ -581,6 +691,8 @@ func webRequestError(w http.ResponseWriter, err *requestError) {
 func webError(w http.ResponseWriter, message string, err error, defaultCode int) {
 	if _, ok := err.(resolver.ErrNoLink); ok {
 		webErrorWithCode(w, message, err, http.StatusNotFound)
+	} else if errors.Is(err, ErrNotFound) {
+		webErrorWithCode(w, message, err, http.StatusNotFound)
 	} else if err == context.DeadlineExceeded {
 		webErrorWithCode(w, message, err, http.StatusRequestTimeout)
 	} else {
@@ -865,27 +977,84 @@ func handleSuperfluousNamespace(w http.ResponseWriter, r *http.Request, contentP
 	return true
 }
 
-func (i *gatewayHandler) handleGettingFirstBlock(r *http.Request, begin time.Time, contentPath Path, resolvedPath Resolved) *requestError {
-	// Update the global metric of the time it takes to read the final root block of the requested resource
-	// NOTE: for legacy reasons this happens before we go into content-type specific code paths
-	ls := i.api.NewSession(r.Context())
+// handleDenylistedPath refuses content paths matching the denylist before any
+// resolution is attempted.
+func (i *gatewayHandler) handleDenylistedPath(denylist *Denylist, contentPath Path) *requestError {
+	if denylist == nil {
+		return nil
+	}
+	if reason, blocked := denylist.checkPath(contentPath.String()); blocked {
+		return newRequestError("content unavailable", errors.New(reason), http.StatusGone)
+	}
+	return nil
+}
+
+// handleDenylistedCids refuses content if the root CID, the CID of any
+// intermediate path segment or the resolved CID matches the denylist.
+func (i *gatewayHandler) handleDenylistedCids(r *http.Request, denylist *Denylist, contentPath Path, resolvedPath Resolved) *requestError {
+	if denylist == nil {
+		return nil
+	}
+	if reason, blocked := denylist.checkCids(resolvedPath.Root(), resolvedPath.Cid()); blocked {
+		return newRequestError("content unavailable", errors.New(reason), http.StatusGone)
+	}
+	roots, err := i.resolveIpfsRoots(r.Context(), contentPath.String(), resolvedPath)
+	if err != nil {
+		return newRequestError("error while resolving path segments", err, http.StatusInternalServerError)
+	}
+	if reason, blocked := denylist.checkCids(roots...); blocked {
+		return newRequestError("content unavailable", errors.New(reason), http.StatusGone)
+	}
+	return nil
+}
+
+// firstBlockContext returns the context of r, bounded by FirstBlockTimeout if
+// it is set.
+func (i *gatewayHandler) firstBlockContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if firstBlockTimeout := i.configFor(r).FirstBlockTimeout; firstBlockTimeout > 0 {
+		return context.WithTimeout(r.Context(), firstBlockTimeout)
+	}
+	return r.Context(), func() {}
+}
+
+// firstBlockTimedOut returns a 504 error if the first block deadline of ctx,
+// and not the request one, passed.
+func (i *gatewayHandler) firstBlockTimedOut(ctx context.Context, r *http.Request, message string) *requestError {
+	if ctx.Err() != context.DeadlineExceeded || r.Context().Err() != nil {
+		return nil
+	}
+	err := fmt.Errorf("root block was not retrieved within %s", i.configFor(r).FirstBlockTimeout)
+	return newRequestError(message, err, http.StatusGatewayTimeout)
+}
+
+// handleGettingFirstBlock loads the final root block of the requested
+// resource, and returns the time it took since begin.
+func (i *gatewayHandler) handleGettingFirstBlock(ctx context.Context, r *http.Request, begin time.Time, contentPath Path, resolvedPath Resolved) (time.Duration, *requestError) {
+	ls := i.api.NewSession(ctx)
 	f := i.api.FetcherForSession(ls)
-	if _, err := f.BlockOfType(r.Context(), cidlink.Link{Cid: resolvedPath.Cid()}, basicnode.Prototype.Any); err != nil {
-		return newRequestError("ipfs block get "+resolvedPath.Cid().String(), err, http.StatusInternalServerError)
+	if _, err := f.BlockOfType(ctx, cidlink.Link{Cid: resolvedPath.Cid()}, basicnode.Prototype.Any); err != nil {
+		// fail fast if the first block deadline, and not the request one, passed
+		if err := i.firstBlockTimedOut(ctx, r, "ipfs block get "+resolvedPath.Cid().String()); err != nil {
+			return 0, err
+		}
+		return 0, newRequestError("ipfs block get "+resolvedPath.Cid().String(), err, http.StatusInternalServerError)
 	}
+	return time.Since(begin), nil
+}
 
+// observeFirstBlock updates the global metric of the time it takes to read
+// the first block of the requested resource, once per request.
+func (i *gatewayHandler) observeFirstBlock(contentPath Path, timeToGetFirstContentBlock time.Duration) {
 	ns := contentPath.Namespace()
-	timeToGetFirstContentBlock := time.Since(begin).Seconds()
-	i.unixfsGetMetric.WithLabelValues(ns).Observe(timeToGetFirstContentBlock) // deprecated, use firstContentBlockGetMetric instead
-	i.firstContentBlockGetMetric.WithLabelValues(ns).Observe(timeToGetFirstContentBlock)
-	return nil
+	i.unixfsGetMetric.WithLabelValues(ns).Observe(timeToGetFirstContentBlock.Seconds()) // deprecated, use firstContentBlockGetMetric instead
+	i.firstContentBlockGetMetric.WithLabelValues(ns).Observe(timeToGetFirstContentBlock.Seconds())
 }
 
-func (i *gatewayHandler) setCommonHeaders(w http.ResponseWriter, r *http.Request, contentPath Path) *requestError {
-	i.addUserHeaders(w) // ok, _now_ write user's headers.
+func (i *gatewayHandler) setCommonHeaders(w http.ResponseWriter, r *http.Request, contentPath Path, resolvedPath Resolved) *requestError {
+	i.addUserHeaders(w, r) // ok, _now_ write user's headers.
 	w.Header().Set("X-Ipfs-Path", contentPath.String())
 
-	if rootCids, err := i.buildIpfsRootsHeader(contentPath.String(), r); err == nil {
+	if rootCids, err := i.buildIpfsRootsHeader(contentPath.String(), resolvedPath, r); err == nil {
 		w.Header().Set("X-Ipfs-Roots", rootCids)
 	} else { // this should never happen, as we resolved the contentPath already
 		return newRequestError("error while resolving X-Ipfs-Roots", err, http.StatusInternalServerError)
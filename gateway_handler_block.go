@@ -24,6 +24,7 @@ func (i *gatewayHandler) serveRawBlock(ctx context.Context, w http.ResponseWrite
 	f := i.api.FetcherForSession(ls)
 	if _, err := f.BlockOfType(ctx, cidlink.Link{Cid: blockCid}, basicnode.Prototype.Any); err != nil {
 		webError(w, "ipfs block get "+blockCid.String(), err, http.StatusInternalServerError)
+		return
 	}
 
 	_, blockBytes, err := ls.LoadPlusRaw(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: blockCid}, basicnode.Prototype.Any)
@@ -3,11 +3,14 @@ package gateway
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
 	"github.com/ipfs/go-fetcher"
 	gocar "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
@@ -23,6 +26,17 @@ func (i *gatewayHandler) serveCAR(ctx context.Context, w http.ResponseWriter, r
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// Stop streaming when the server shuts down, instead of making it wait
+	// for the whole DAG to be sent.
+	go func() {
+		select {
+		case <-serverShutdown(ctx):
+			log.Debugw("server shutting down, ending CAR stream", "path", contentPath)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	switch carVersion {
 	case "": // noop, client does not care about version
 	case "1": // noop, we support this
@@ -70,7 +84,19 @@ func (i *gatewayHandler) serveCAR(ctx context.Context, w http.ResponseWriter, r
 		return
 	}
 
-	if _, err := gocar.TraverseV1(ctx, ls, rootCid, selectorparse.CommonSelector_ExploreAllRecursively, w); err != nil {
+	// Flush what was written so far before loading each block, so clients
+	// receive blocks as they are traversed instead of when the response
+	// buffer happens to fill up, which matters when blocks are slow to load.
+	carLs := *ls
+	if flusher, ok := w.(http.Flusher); ok {
+		opener := ls.StorageReadOpener
+		carLs.StorageReadOpener = func(lctx linking.LinkContext, lnk ipld.Link) (io.Reader, error) {
+			flusher.Flush()
+			return opener(lctx, lnk)
+		}
+	}
+
+	if _, err := gocar.TraverseV1(ctx, &carLs, rootCid, selectorparse.CommonSelector_ExploreAllRecursively, w); err != nil {
 		w.Header().Set("X-Stream-Error", err.Error())
 		return
 	}
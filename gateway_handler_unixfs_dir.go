@@ -2,16 +2,16 @@ package gateway
 
 import (
 	"context"
+	"errors"
+	"html"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-fetcher"
 	gopath "github.com/ipfs/go-path"
 	"github.com/ipld/go-ipld-prime"
-	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -21,7 +21,9 @@ import (
 // serveDirectory returns the best representation of UnixFS directory
 //
 // It will return index.html if present, or generate directory listing otherwise.
-func (i *gatewayHandler) serveDirectory(ctx context.Context, w http.ResponseWriter, r *http.Request, resolvedPath Resolved, contentPath Path, dir ipld.Node, begin time.Time, logger *zap.SugaredLogger) {
+// The time to the first block of the index.html is recorded in place of
+// firstBlock, the one of the directory.
+func (i *gatewayHandler) serveDirectory(ctx context.Context, w http.ResponseWriter, r *http.Request, resolvedPath Resolved, contentPath Path, dir ipld.Node, begin time.Time, firstBlock time.Duration, logger *zap.SugaredLogger) {
 	ctx, span := otel.Tracer("gateway").Start(ctx, "gateway.serveDirectory", trace.WithAttributes(attribute.String("path", resolvedPath.String())))
 	defer span.End()
 
@@ -40,15 +42,26 @@ func (i *gatewayHandler) serveDirectory(ctx context.Context, w http.ResponseWrit
 	// Check if directory has index.html, if so, serveFile
 	if idx, err := dir.LookupByString("index.html"); err == nil {
 		idxPath := JoinPath(resolvedPath, "index.html")
-		// make sure we've loaded the index.
-		ls := i.api.NewSession(ctx)
-		fetchSession := i.api.FetcherForSession(ls)
-		err := fetchSession.NodeMatching(ctx, idx, selectorparse.CommonSelector_ExploreAllRecursively, func(_ fetcher.FetchResult) error { return nil })
-		if err != nil {
-			internalWebError(w, err)
-			return
+		// the blocks of the index are loaded as it is streamed
+		if idx.Kind() == ipld.Kind_Link {
+			lnk, err := idx.AsLink()
+			if err == nil {
+				idx, err = i.loadFile(ctx, r, lnk)
+			}
+			if err != nil {
+				i.observeFirstBlock(contentPath, firstBlock)
+				// children are no longer fetched upfront by serveUnixFS
+				if errors.Is(err, ErrNotFound) {
+					webError(w, "ipfs cat "+html.EscapeString(idxPath.String()), err, http.StatusNotFound)
+					return
+				}
+				internalWebError(w, err)
+				return
+			}
+			// the time to the index replaces the one to the directory
+			firstBlock = time.Since(begin)
 		}
-
+		i.observeFirstBlock(contentPath, firstBlock)
 		cpath := contentPath.String()
 		dirwithoutslash := cpath[len(cpath)-1] != '/'
 		goget := r.URL.Query().Get("go-get") == "1"
@@ -72,6 +85,8 @@ func (i *gatewayHandler) serveDirectory(ctx context.Context, w http.ResponseWrit
 		return
 	}
 
+	i.observeFirstBlock(contentPath, firstBlock)
+
 	// See statusResponseWriter.WriteHeader
 	// and https://github.com/ipfs/go-ipfs/issues/7164
 	// Note: this needs to occur before listingTemplate.Execute otherwise we get
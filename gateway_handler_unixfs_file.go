@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/gabriel-vasile/mimetype"
+	"github.com/ipfs/go-unixfsnode"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"go.opentelemetry.io/otel"
@@ -19,6 +20,19 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
+// loadFile returns the UnixFS file at lnk, in a new session whose blocks are
+// loaded as the file is read.
+func (i *gatewayHandler) loadFile(ctx context.Context, r *http.Request, lnk ipld.Link) (ipld.Node, error) {
+	ls := i.api.NewSession(ctx)
+	ls = withReadAhead(ctx, ls, i.configFor(r).ReadAheadBlocks)
+	proto, _ := i.api.FetcherForSession(ls).PrototypeFromLink(lnk)
+	node, err := ls.Load(ipld.LinkContext{Ctx: ctx}, lnk, proto)
+	if err != nil {
+		return nil, err
+	}
+	return unixfsnode.Reify(ipld.LinkContext{Ctx: ctx}, node, ls)
+}
+
 // serveFile returns data behind a file along with HTTP headers based on
 // the file itself, its CID and the contentPath used for accessing it.
 func (i *gatewayHandler) serveFile(ctx context.Context, w http.ResponseWriter, r *http.Request, resolvedPath Resolved, contentPath Path, file ipld.Node, begin time.Time) {
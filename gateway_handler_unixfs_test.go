@@ -0,0 +1,202 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/multiformats/go-multihash"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// heldAPI serves the blocks of a memstore, but loading the held block waits
+// for release to be closed.
+type heldAPI struct {
+	store   *memstore.Store
+	held    string
+	release chan struct{}
+}
+
+func (a *heldAPI) NewSession(context.Context) *ipld.LinkSystem {
+	ls := lsfetcher.NewLinkSystem(a)
+	return &ls
+}
+
+func (a *heldAPI) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+func (a *heldAPI) Resolve(_ context.Context, name string) (string, error) {
+	return name, nil
+}
+
+func (a *heldAPI) Has(ctx context.Context, key string) (bool, error) {
+	return a.store.Has(ctx, key)
+}
+
+func (a *heldAPI) Get(ctx context.Context, key string) ([]byte, error) {
+	if key == a.held {
+		select {
+		case <-a.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	data, err := a.store.Get(ctx, key)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func unixfsServer(t *testing.T, a API) *httptest.Server {
+	t.Helper()
+	h, err := makeHandler(a, &GatewayConfig{}, nil, GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// TestLazyFiles checks that index.html and ipfs-404.html are streamed as
+// their blocks are loaded, rather than once the whole file is.
+func TestLazyFiles(t *testing.T) {
+	a := &heldAPI{store: &memstore.Store{Bag: map[string][]byte{}}, release: make(chan struct{})}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(a.store)
+	ls.SetWriteStorage(a.store)
+
+	content := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	var entries []dagpb.PBLink
+	for _, name := range []string{"index.html", "ipfs-404.html"} {
+		lnk, size, err := builder.BuildUnixFSFile(bytes.NewReader(content), "size-1024", &ls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), lnk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	root, _, err := builder.BuildUnixFSDirectory(entries, &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both files share their blocks, hold the last one
+	last := content[len(content)-1024:]
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.held = string(c.Bytes())
+	if _, ok := a.store.Bag[a.held]; !ok {
+		t.Fatal("expected the files to have raw leaves")
+	}
+
+	url := unixfsServer(t, a).URL + "/ipfs/" + root.(cidlink.Link).Cid.String()
+	var responses []*http.Response
+	// index.html in place of the directory, then the 404 page, which has no
+	// path to resolve
+	for _, path := range []string{"/", "/nope"} {
+		before := firstBlockObservations(t)
+		req, _ := http.NewRequest(http.MethodGet, url+path, nil)
+		req.Header.Set("Accept", "text/html")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+			body, _ := ioutil.ReadAll(res.Body)
+			t.Fatalf("%s: unexpected status %d: %s", path, res.StatusCode, body)
+		}
+		first := make([]byte, 1024)
+		if _, err := io.ReadFull(res.Body, first); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, content[:1024]) {
+			t.Fatalf("%s: unexpected first block", path)
+		}
+		// observed before the held block is released
+		if n := firstBlockObservations(t) - before; n != 1 {
+			t.Fatalf("%s: expected a single first block observation, got %d", path, n)
+		}
+		responses = append(responses, res)
+	}
+
+	close(a.release)
+	for _, res := range responses {
+		rest, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, content[1024:]) {
+			t.Fatalf("unexpected content")
+		}
+	}
+}
+
+// firstBlockObservations returns the number of times the time to the first
+// content block of /ipfs paths was observed.
+func firstBlockObservations(t *testing.T) uint64 {
+	t.Helper()
+	snap, err := newConfigSnapshot(&GatewayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the metrics are shared by all handlers
+	h := newGatewayHandler(snap, nil).firstContentBlockGetMetric
+	var m dto.Metric
+	if err := h.WithLabelValues("ipfs").(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestMissingIndex(t *testing.T) {
+	a := &heldAPI{store: &memstore.Store{Bag: map[string][]byte{}}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(a.store)
+	ls.SetWriteStorage(a.store)
+	lnk, size, err := builder.BuildUnixFSFile(bytes.NewReader([]byte("<html></html>")), "", &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := builder.BuildUnixFSDirectoryEntry("index.html", int64(size), lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := builder.BuildUnixFSDirectory([]dagpb.PBLink{entry}, &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(a.store.Bag, string(lnk.(cidlink.Link).Cid.Bytes()))
+
+	res, err := http.Get(unixfsServer(t, a).URL + "/ipfs/" + root.(cidlink.Link).Cid.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a missing index.html to be 404, got %d", res.StatusCode)
+	}
+}
@@ -10,13 +10,17 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
 	"github.com/ipfs-shipyard/gateway-prime/mock"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
 	quickbuilder "github.com/ipfs/go-unixfsnode/data/builder/quick"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
 	id "github.com/libp2p/go-libp2p/p2p/protocol/identify"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
@@ -618,3 +622,197 @@ func TestEtagMatch(t *testing.T) {
 		}
 	}
 }
+
+// stallingAPI never manages to fetch any block.
+type stallingAPI struct {
+	mock.API
+}
+
+func (s *stallingAPI) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return stallingFetcher{s.API.FetcherForSession(ls)}
+}
+
+type stallingFetcher struct {
+	fetcher.Fetcher
+}
+
+func (stallingFetcher) BlockOfType(ctx context.Context, _ ipld.Link, _ ipld.NodePrototype) (ipld.Node, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestFirstBlockTimeout(t *testing.T) {
+	a := &stallingAPI{}
+	h, err := makeHandler(a, &GatewayConfig{FirstBlockTimeout: 50 * time.Millisecond}, nil, GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	res, err := http.Get(ts.URL + emptyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status is %d, expected %d", res.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+// slowRootAPI loads blocks through its LinkSystem, but never manages to load
+// the root block.
+type slowRootAPI struct {
+	store *memstore.Store
+	root  string
+}
+
+func (a *slowRootAPI) NewSession(context.Context) *ipld.LinkSystem {
+	ls := lsfetcher.NewLinkSystem(a)
+	return &ls
+}
+
+func (a *slowRootAPI) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+func (a *slowRootAPI) Resolve(_ context.Context, name string) (string, error) {
+	return name, nil
+}
+
+func (a *slowRootAPI) Has(ctx context.Context, key string) (bool, error) {
+	return a.store.Has(ctx, key)
+}
+
+func (a *slowRootAPI) Get(ctx context.Context, key string) ([]byte, error) {
+	if key == a.root {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return a.store.Get(ctx, key)
+}
+
+func TestFirstBlockTimeoutResolving(t *testing.T) {
+	a := &slowRootAPI{store: &memstore.Store{Bag: map[string][]byte{}}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(a.store)
+	ls.SetWriteStorage(a.store)
+	var root cid.Cid
+	if err := quickbuilder.Store(&ls, func(b *quickbuilder.Builder) error {
+		root = b.NewMapDirectory(map[string]quickbuilder.Node{
+			"a": b.NewMapDirectory(map[string]quickbuilder.Node{
+				"b": b.NewBytesFile([]byte("b")),
+			}),
+		}).Link().(cidlink.Link).Cid
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	a.root = root.KeyString()
+
+	h, err := makeHandler(a, &GatewayConfig{FirstBlockTimeout: 50 * time.Millisecond}, nil, GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	// resolving the path loads the root block
+	c := &http.Client{Timeout: 5 * time.Second}
+	res, err := c.Get(ts.URL + "/ipfs/" + root.String() + "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status is %d, expected %d", res.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+func TestPerGatewayHeaders(t *testing.T) {
+	a := &mock.API{}
+	var file cid.Cid
+	if err := quickbuilder.Store(a.NewSession(context.Background()), func(b *quickbuilder.Builder) error {
+		file = b.NewBytesFile([]byte("hello")).Link().(cidlink.Link).Cid
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := makeHandler(a, &GatewayConfig{
+		HTTPHeaders: map[string][]string{"X-Frame-Options": {"DENY"}},
+		PublicGateways: map[string]*GatewaySpec{
+			"embed.example.com": {
+				Paths:            []string{"/ipfs"},
+				HTTPHeaders:      map[string][]string{"x-frame-options": {"SAMEORIGIN"}, "X-Custom": {"yes"}},
+				CORSAllowOrigins: []string{"https://app.example.com"},
+				CORSAllowMethods: []string{http.MethodGet, http.MethodHead},
+			},
+			"sub.example.com": {
+				Paths:            []string{"/ipfs"},
+				UseSubdomains:    true,
+				CORSAllowOrigins: []string{"*"},
+			},
+		},
+	}, nil, HostnameOption(), GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		method  string
+		host    string
+		origin  string
+		headers map[string]string
+	}{
+		// globals on unknown hosts
+		{http.MethodOptions, "other.example.com", "", map[string]string{
+			"X-Frame-Options":              "DENY",
+			"Access-Control-Allow-Origin":  "*",
+			"Access-Control-Allow-Methods": "GET",
+			"X-Custom":                     "",
+		}},
+		// per-host preflight
+		{http.MethodOptions, "embed.example.com", "https://app.example.com", map[string]string{
+			"X-Frame-Options":              "SAMEORIGIN",
+			"X-Custom":                     "yes",
+			"Access-Control-Allow-Origin":  "https://app.example.com",
+			"Access-Control-Allow-Methods": "GET, HEAD",
+			"Vary":                         "Origin",
+		}},
+		{http.MethodOptions, "embed.example.com", "https://evil.example.com", map[string]string{
+			"Access-Control-Allow-Origin": "",
+			"Vary":                        "Origin",
+		}},
+		{http.MethodGet, "embed.example.com", "https://app.example.com", map[string]string{
+			"X-Frame-Options":             "SAMEORIGIN",
+			"Access-Control-Allow-Origin": "https://app.example.com",
+		}},
+		{http.MethodGet, file.String() + ".ipfs.sub.example.com", "https://anything.example.com", map[string]string{
+			"X-Frame-Options":             "DENY",
+			"Access-Control-Allow-Origin": "*",
+		}},
+	} {
+		target := "/ipfs/" + file.String()
+		if strings.HasSuffix(test.host, ".sub.example.com") {
+			target = "/"
+		}
+		r := httptest.NewRequest(test.method, target, nil)
+		r.Host = test.host
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %s%s: unexpected status %d: %s", test.method, test.host, target, w.Code, w.Body.String())
+			continue
+		}
+		for k, v := range test.headers {
+			if got := strings.Join(w.Header().Values(k), ", "); got != v {
+				t.Errorf("%s %s (origin %q): header %s is %q, expected %q", test.method, test.host, test.origin, k, got, v)
+			}
+		}
+	}
+}
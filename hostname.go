@@ -34,9 +34,15 @@ func HostnameOption() ServeOption {
 	return func(a API, gc *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
 		childMux := http.NewServeMux()
 
-		knownGateways := prepareKnownGateways(gc.PublicGateways)
+		fallback, err := newConfigSnapshot(gc)
+		if err != nil {
+			return nil, err
+		}
 
 		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			snap := configSnapshotFor(r, fallback)
+			cfg, knownGateways := snap.config, snap.knownGateways
+
 			// Unfortunately, many (well, ipfs.io) gateways use
 			// DNSLink so if we blindly rewrite with DNSLink, we'll
 			// break /ipfs links.
@@ -45,17 +51,19 @@ func HostnameOption() ServeOption {
 			// and the paths that they serve "gateway" content on.
 			// That way, we can use DNSLink for everything else.
 
-			// Support X-Forwarded-Host if added by a reverse proxy
-			// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-Host
-			host := r.Host
-			if xHost := r.Header.Get("X-Forwarded-Host"); xHost != "" {
-				host = xHost
-			}
+			// Host as seen by the client, which may differ from r.Host
+			// when a trusted reverse proxy forwarded the request
+			host, _ := requestOrigin(r)
 
 			// HTTP Host & Path check: is this one of our  "known gateways"?
 			if gw, ok := isKnownHostname(host, knownGateways); ok {
 				// This is a known gateway but request is not using
 				// the subdomain feature.
+				api, err := gatewayAPI(r, gw, a)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
 
 				// Does this gateway _handle_ this path?
 				if hasPrefix(r.URL.Path, gw.Paths...) {
@@ -65,7 +73,7 @@ func HostnameOption() ServeOption {
 					if gw.UseSubdomains {
 						// Yes, redirect if applicable
 						// Example: dweb.link/ipfs/{cid} → {cid}.ipfs.dweb.link
-						newURL, err := toSubdomainURL(host, r.URL.Path, r, a)
+						newURL, err := toSubdomainURL(host, r.URL.Path, r, api)
 						if err != nil {
 							http.Error(w, err.Error(), http.StatusBadRequest)
 							return
@@ -85,7 +93,7 @@ func HostnameOption() ServeOption {
 
 					// Not a subdomain resource, continue with path processing
 					// Example: 127.0.0.1:8080/ipfs/{CID}, ipfs.io/ipfs/{CID} etc
-					childMux.ServeHTTP(w, r)
+					childMux.ServeHTTP(w, withGatewaySpecContext(r, gw))
 					return
 				}
 				// Not a whitelisted path
@@ -101,6 +109,11 @@ func HostnameOption() ServeOption {
 			// /ipns/ example: {libp2p-key}.ipns.localhost:8080, {inlined-dnslink-fqdn}.ipns.dweb.link
 			if gw, gwHostname, ns, rootID, ok := knownSubdomainDetails(host, knownGateways); ok {
 				// Looks like we're using a known gateway in subdomain mode.
+				api, err := gatewayAPI(r, gw, a)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
 
 				// Assemble original path prefix.
 				pathPrefix := "/" + ns + "/" + rootID
@@ -120,9 +133,9 @@ func HostnameOption() ServeOption {
 						http.Error(w, err.Error(), http.StatusBadRequest)
 						return
 					}
-					if !strings.HasPrefix(r.Host, dnsCID) {
+					if !strings.HasPrefix(host, dnsCID) {
 						dnsPrefix := "/" + ns + "/" + dnsCID
-						newURL, err := toSubdomainURL(gwHostname, dnsPrefix+r.URL.Path, r, a)
+						newURL, err := toSubdomainURL(gwHostname, dnsPrefix+r.URL.Path, r, api)
 						if err != nil {
 							http.Error(w, err.Error(), http.StatusBadRequest)
 							return
@@ -138,7 +151,7 @@ func HostnameOption() ServeOption {
 					// Do we need to fix multicodec in PeerID represented as CIDv1?
 					if isPeerIDNamespace(ns) {
 						if rootCID.Type() != cid.Libp2pKey {
-							newURL, err := toSubdomainURL(gwHostname, pathPrefix+r.URL.Path, r, a)
+							newURL, err := toSubdomainURL(gwHostname, pathPrefix+r.URL.Path, r, api)
 							if err != nil {
 								http.Error(w, err.Error(), http.StatusBadRequest)
 								return
@@ -155,11 +168,18 @@ func HostnameOption() ServeOption {
 				r.URL.Path = pathPrefix + r.URL.Path
 
 				// Serve path request
-				childMux.ServeHTTP(w, withHostnameContext(r, gwHostname))
+				childMux.ServeHTTP(w, withGatewaySpecContext(withHostnameContext(r, gwHostname), gw))
 				return
 			}
 			// We don't have a known gateway. Fallback on DNSLink lookup
 
+			// In strict mode, only serve hosts we were told about
+			if cfg.StrictHosts && !isAllowedHost(host, cfg.AllowedHosts) &&
+				!(cfg.StrictHostsDNSLink && !cfg.NoDNSLink && isDNSLinkName(r.Context(), a, host)) {
+				http.Error(w, fmt.Sprintf("misdirected request: unknown host %q", host), http.StatusMisdirectedRequest)
+				return
+			}
+
 			// else, treat it as an old school gateway, I guess.
 			childMux.ServeHTTP(w, r)
 		})
@@ -167,6 +187,16 @@ func HostnameOption() ServeOption {
 	}
 }
 
+// gatewayAPI returns the API serving the known gateway gw: its backend if it
+// names one, a otherwise.
+func gatewayAPI(r *http.Request, gw *GatewaySpec, a API) (API, error) {
+	api, ok, err := backendFor(r.Context(), gw)
+	if err != nil || !ok {
+		return a, err
+	}
+	return api, nil
+}
+
 type gatewayHosts struct {
 	exact    map[string]*GatewaySpec
 	wildcard []wildcardHost
@@ -177,6 +207,15 @@ type wildcardHost struct {
 	spec *GatewaySpec
 }
 
+type gatewaySpecKeyType struct{}
+
+// gatewaySpecKey holds the PublicGateways entry matching the request host.
+var gatewaySpecKey gatewaySpecKeyType
+
+func withGatewaySpecContext(r *http.Request, gw *GatewaySpec) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), gatewaySpecKey, gw))
+}
+
 type HostnameKey string
 
 var GatewayHostnameKey HostnameKey = "gw-hostname"
@@ -211,19 +250,7 @@ func prepareKnownGateways(publicGateways map[string]*GatewaySpec) gatewayHosts {
 			continue
 		}
 		if strings.Contains(hostname, "*") {
-			// from *.domain.tld, construct a regexp that match any direct subdomain
-			// of .domain.tld.
-			//
-			// Regexp will be in the form of ^[^.]+\.domain.tld(?::\d+)?$
-
-			escaped := strings.ReplaceAll(hostname, ".", `\.`)
-			regexed := strings.ReplaceAll(escaped, "*", "[^.]+")
-
-			re, err := regexp.Compile(fmt.Sprintf(`^%s(?::\d+)?$`, regexed))
-			if err != nil {
-				log.Warn("invalid wildcard gateway hostname \"%s\"", hostname)
-			}
-
+			re := wildcardHostRegexp(hostname)
 			hosts.wildcard = append(hosts.wildcard, wildcardHost{re: re, spec: gw})
 		} else {
 			hosts.exact[hostname] = gw
@@ -233,6 +260,21 @@ func prepareKnownGateways(publicGateways map[string]*GatewaySpec) gatewayHosts {
 	return hosts
 }
 
+// wildcardHostRegexp turns *.domain.tld into a regexp that matches any direct
+// subdomain of .domain.tld, with an optional port.
+//
+// Regexp will be in the form of ^[^.]+\.domain\.tld(?::\d+)?$, the rest of
+// the hostname being matched literally.
+func wildcardHostRegexp(hostname string) *regexp.Regexp {
+	parts := strings.Split(hostname, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	regexed := strings.Join(parts, "[^.]+")
+
+	return regexp.MustCompile(fmt.Sprintf(`^%s(?::\d+)?$`, regexed))
+}
+
 // isKnownHostname checks Gateway.PublicGateways and returns matching
 // GatewaySpec with graceful fallback to version without port
 func isKnownHostname(hostname string, knownGateways gatewayHosts) (gw *GatewaySpec, ok bool) {
@@ -255,6 +297,28 @@ func isKnownHostname(hostname string, knownGateways gatewayHosts) (gw *GatewaySp
 	return nil, false
 }
 
+// isAllowedHost checks if hostname (host+optional port) matches one of the
+// AllowedHosts patterns.
+func isAllowedHost(hostname string, patterns []string) bool {
+	hostname = strings.ToLower(hostname)
+	bare := stripPort(hostname)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			// wildcards match a single label, with any port
+			label := strings.TrimSuffix(bare, pattern[1:])
+			if label != bare && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+			continue
+		}
+		if pattern == hostname || pattern == bare {
+			return true
+		}
+	}
+	return false
+}
+
 // Parses Host header and looks for a known gateway matching subdomain host.
 // If found, returns GatewaySpec and subdomain components extracted from Host
 // header: {rootID}.{ns}.{gwHostname}
@@ -356,12 +420,10 @@ func toDNSLabel(rootID string, rootCID cid.Cid) (dnsCID string, err error) {
 // See https://github.com/ipfs/in-web-browsers/issues/169 to understand how it
 // impacts DNSLink websites on public gateways.
 func isHTTPSRequest(r *http.Request) bool {
-	// X-Forwarded-Proto if added by a reverse proxy
-	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-Proto
-	xproto := r.Header.Get("X-Forwarded-Proto")
-	// Is request a native TLS (not used atm, but future-proofing)
-	// or a proxied HTTPS (eg. go-ipfs behind nginx at a public gw)?
-	return r.URL.Scheme == "https" || xproto == "https"
+	// Is request a native TLS (ServeTLS) or a proxied HTTPS (eg. go-ipfs
+	// behind nginx at a public gw)?
+	_, scheme := requestOrigin(r)
+	return scheme == "https"
 }
 
 // Converts a FQDN to DNS-safe representation that fits in 63 characters:
@@ -478,7 +540,7 @@ func toSubdomainURL(hostname, path string, r *http.Request, a API) (redirURL str
 		// Check if rootID is a FQDN with DNSLink and convert it to TLS-safe
 		// representation that fits in a single DNS label.  We support this so
 		// loading DNSLink names over TLS "just works" on public HTTP gateways
-		// that pass 'https' in X-Forwarded-Proto to go-ipfs.
+		// that pass 'https' in Forwarded or X-Forwarded-Proto to go-ipfs.
 		//
 		// Rationale can be found under "Option C"
 		// at: https://github.com/ipfs/in-web-browsers/issues/169
@@ -12,6 +12,7 @@ import (
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/multiformats/go-multihash"
 )
 
 func TestToSubdomainURL(t *testing.T) {
@@ -29,6 +30,7 @@ func TestToSubdomainURL(t *testing.T) {
 	httpsRequest := httptest.NewRequest("GET", "https://https-request-stub.example.com", nil)
 	httpsProxiedRequest := httptest.NewRequest("GET", "http://proxied-https-request-stub.example.com", nil)
 	httpsProxiedRequest.Header.Set("X-Forwarded-Proto", "https")
+	httpsProxiedRequest = withTrustedRemote(t, httpsProxiedRequest)
 
 	for _, test := range []struct {
 		// in:
@@ -97,13 +99,34 @@ func TestToDNSLinkFQDN(t *testing.T) {
 	}
 }
 
+// withTrustedRemote processes the request as if it came from a trusted
+// reverse proxy.
+func withTrustedRemote(t *testing.T, r *http.Request) *http.Request {
+	t.Helper()
+	proxies, err := parseTrustedProxies([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	return withRequestOrigin(r, proxies)
+}
+
 func TestIsHTTPSRequest(t *testing.T) {
 	httpRequest := httptest.NewRequest("GET", "http://127.0.0.1:8080", nil)
 	httpsRequest := httptest.NewRequest("GET", "https://https-request-stub.example.com", nil)
 	httpsProxiedRequest := httptest.NewRequest("GET", "http://proxied-https-request-stub.example.com", nil)
 	httpsProxiedRequest.Header.Set("X-Forwarded-Proto", "https")
+	httpsProxiedRequest = withTrustedRemote(t, httpsProxiedRequest)
 	httpProxiedRequest := httptest.NewRequest("GET", "http://proxied-http-request-stub.example.com", nil)
 	httpProxiedRequest.Header.Set("X-Forwarded-Proto", "http")
+	httpProxiedRequest = withTrustedRemote(t, httpProxiedRequest)
+	httpsForwardedRequest := httptest.NewRequest("GET", "http://forwarded-https-request-stub.example.com", nil)
+	httpsForwardedRequest.Header.Set("Forwarded", "for=198.51.100.17;proto=https")
+	httpsForwardedRequest = withTrustedRemote(t, httpsForwardedRequest)
+	spoofedRequest := httptest.NewRequest("GET", "http://spoofed-https-request-stub.example.com", nil)
+	spoofedRequest.RemoteAddr = "198.51.100.17:1234"
+	spoofedRequest.Header.Set("X-Forwarded-Proto", "https")
+	spoofedRequest.Header.Set("Forwarded", "proto=https")
 	oddballRequest := httptest.NewRequest("GET", "foo://127.0.0.1:8080", nil)
 	for _, test := range []struct {
 		in  *http.Request
@@ -113,6 +136,8 @@ func TestIsHTTPSRequest(t *testing.T) {
 		{httpsRequest, true},
 		{httpsProxiedRequest, true},
 		{httpProxiedRequest, false},
+		{httpsForwardedRequest, true},
+		{spoofedRequest, false},
 		{oddballRequest, false},
 	} {
 		out := isHTTPSRequest(test.in)
@@ -297,3 +322,57 @@ func TestKnownSubdomainDetails(t *testing.T) {
 func equalError(a, b error) bool {
 	return (a == nil && b == nil) || (a != nil && b != nil && a.Error() == b.Error())
 }
+
+func TestStrictHosts(t *testing.T) {
+	a := &mock.API{
+		Resolver: mock.Namesys{"/ipns/dnslink.example.com": "/ipfs/bafkqaaa"},
+		ResolverFailures: mock.NamesysErrors{
+			"/ipns/rebind.example.com": errors.New("no DNSLink"),
+			"/ipns/evil.example.com":   errors.New("no DNSLink"),
+		},
+	}
+	lnk, err := a.NewSession(context.Background()).Store(ipld.LinkContext{}, cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   multihash.SHA2_256,
+		MhLength: -1,
+	}}, basicnode.NewBytes([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/ipfs/" + lnk.String()
+
+	for _, test := range []struct {
+		dnslink bool
+		host    string
+		status  int
+	}{
+		{false, "gw.example.com", http.StatusOK},
+		{false, "gw.example.com:8080", http.StatusOK},
+		{false, "10.0.0.1:8080", http.StatusOK},
+		{false, "tenant.allowed.example.com", http.StatusOK},
+		{false, "a.tenant.allowed.example.com", http.StatusMisdirectedRequest},
+		{false, "localhost:8080", http.StatusMovedPermanently}, // redirect to subdomain
+		{false, "rebind.example.com", http.StatusMisdirectedRequest},
+		{false, "", http.StatusMisdirectedRequest},
+		{false, "dnslink.example.com", http.StatusMisdirectedRequest},
+		{true, "dnslink.example.com", http.StatusOK},
+		{true, "evil.example.com", http.StatusMisdirectedRequest},
+	} {
+		h, err := makeHandler(a, &GatewayConfig{
+			StrictHosts:        true,
+			StrictHostsDNSLink: test.dnslink,
+			AllowedHosts:       []string{"GW.example.com", "10.0.0.1:8080", "*.allowed.example.com"},
+		}, nil, HostnameOption(), GatewayOption("/ipfs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("host %q (dnslink: %t): got %d, expected %d", test.host, test.dnslink, w.Code, test.status)
+		}
+	}
+}
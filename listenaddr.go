@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// toListenMultiaddr converts a listen address to a multiaddr. Accepted forms
+// are:
+//
+//	/ip4/127.0.0.1/tcp/8080   multiaddr, used as-is
+//	127.0.0.1:8080            host:port, with an IP or a resolvable hostname
+//	:8080                     port on all IPv4 interfaces (/ip4/0.0.0.0/tcp/8080)
+//	[::1]:8080                IPv6 host:port
+//	http://127.0.0.1:8080     URL, the port defaults to 80
+//	unix:///run/gateway.sock  unix domain socket
+//	unix://run/gateway.sock   unix domain socket, relative to the working directory
+func toListenMultiaddr(addr string) (ma.Multiaddr, error) {
+	addr = strings.TrimSpace(addr)
+	switch {
+	case addr == "":
+		return nil, fmt.Errorf("empty listen address")
+	case strings.HasPrefix(addr, "/"):
+		return ma.NewMultiaddr(addr)
+	case strings.Contains(addr, "://"):
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		switch u.Scheme {
+		case "unix":
+			// accept both unix:///abs/path and unix://rel/path, whose first
+			// segment is parsed as the host
+			p := u.Host + u.Path
+			if p == "" {
+				return nil, fmt.Errorf("invalid listen address %q: missing socket path", addr)
+			}
+			if u.Host != "" {
+				abs, err := filepath.Abs(p)
+				if err != nil {
+					return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+				}
+				p = abs
+			}
+			return ma.NewMultiaddr("/unix" + p)
+		case "http", "tcp":
+			hostport := u.Host
+			if u.Port() == "" {
+				hostport = net.JoinHostPort(u.Hostname(), "80")
+			}
+			return hostPortToMultiaddr(hostport)
+		default:
+			return nil, fmt.Errorf("invalid listen address %q: unsupported scheme %q", addr, u.Scheme)
+		}
+	default:
+		return hostPortToMultiaddr(addr)
+	}
+}
+
+func hostPortToMultiaddr(hostport string) (ma.Multiaddr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", hostport, err)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: invalid port %q", hostport, port)
+	}
+	port = strconv.FormatUint(portNum, 10)
+
+	var ip net.IP
+	if host == "" {
+		ip = net.IPv4zero
+	} else if ip = net.ParseIP(host); ip == nil {
+		// We can only listen on IPs, so resolve hostnames such as localhost
+		// upfront, preferring IPv4.
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return nil, fmt.Errorf("invalid listen address %q: failed to resolve host: %v", hostport, err)
+		}
+		ip = ips[0]
+		for _, candidate := range ips {
+			if candidate.To4() != nil {
+				ip = candidate
+				break
+			}
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ma.NewMultiaddr("/ip4/" + ip4.String() + "/tcp/" + port)
+	}
+	return ma.NewMultiaddr("/ip6/" + ip.String() + "/tcp/" + port)
+}
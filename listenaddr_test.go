@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs-shipyard/gateway-prime/mock"
+)
+
+func TestToListenMultiaddr(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{"/ip4/127.0.0.1/tcp/8080", "/ip4/127.0.0.1/tcp/8080", false},
+		{"/unix/tmp/gw.sock", "/unix/tmp/gw.sock", false},
+		{":8080", "/ip4/0.0.0.0/tcp/8080", false},
+		{"127.0.0.1:8080", "/ip4/127.0.0.1/tcp/8080", false},
+		{"0.0.0.0:0", "/ip4/0.0.0.0/tcp/0", false},
+		{"[::1]:8080", "/ip6/::1/tcp/8080", false},
+		{"[::]:8080", "/ip6/::/tcp/8080", false},
+		{"http://127.0.0.1:8080", "/ip4/127.0.0.1/tcp/8080", false},
+		{"http://127.0.0.1", "/ip4/127.0.0.1/tcp/80", false},
+		{"http://127.0.0.1:8080/ignored/path", "/ip4/127.0.0.1/tcp/8080", false},
+		{"tcp://[::1]:8080", "/ip6/::1/tcp/8080", false},
+		{"unix:///run/gateway.sock", "/unix/run/gateway.sock", false},
+		{"unix://gateway.sock", "/unix" + filepath.Join(wd, "gateway.sock"), false},
+		{"unix://run/gateway.sock", "/unix" + filepath.Join(wd, "run/gateway.sock"), false},
+		{"", "", true},
+		{"8080", "", true},
+		{"127.0.0.1:99999", "", true},
+		{"127.0.0.1:http", "", true},
+		{"ftp://127.0.0.1:21", "", true},
+		{"unix://", "", true},
+		{"/ip4/not-an-ip/tcp/1", "", true},
+	} {
+		out, err := toListenMultiaddr(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("toListenMultiaddr(%q): expected an error, got %s", test.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("toListenMultiaddr(%q): unexpected error: %s", test.in, err)
+			continue
+		}
+		if out.String() != test.out {
+			t.Errorf("toListenMultiaddr(%q) = %s, expected %s", test.in, out, test.out)
+		}
+	}
+}
+
+func TestListenAndServeMultipleAddrs(t *testing.T) {
+	dir := t.TempDir()
+	server, err := ListenAndServeAddrs(&mock.API{}, &GatewayConfig{},
+		[]string{"127.0.0.1:0", "unix://" + dir + "/gw.sock"},
+		VersionOption("go-ipfs/0.13.0-dev/unknown", "theshortcommithash"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if len(server.Addrs()) != 2 {
+		t.Fatalf("expected 2 listen addresses, got %v", server.Addrs())
+	}
+
+	res, err := http.Get("http://" + server.Addrs()[0].String() + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "theshortcommithash") {
+		t.Fatalf("unexpected response: %s", body)
+	}
+
+	if _, err := ListenAndServeAddrs(&mock.API{}, &GatewayConfig{}, []string{"127.0.0.1:0", "not-an-address"}); err == nil {
+		t.Fatal("expected an error for an invalid address")
+	}
+
+	// a single address, as before
+	single, err := ListenAndServe(&mock.API{}, &GatewayConfig{}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	if len(single.Addrs()) != 1 {
+		t.Fatalf("expected 1 listen address, got %v", single.Addrs())
+	}
+}
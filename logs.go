@@ -4,6 +4,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync"
 
 	lwriter "github.com/ipfs/go-log/writer"
 )
@@ -11,6 +12,11 @@ import (
 type writeErrNotifier struct {
 	w    io.Writer
 	errs chan error
+
+	// lk serialises writes with Close, so that nothing reaches w once the
+	// handler owning it has returned.
+	lk     sync.Mutex
+	closed bool
 }
 
 func newWriteErrNotifier(w io.Writer) (io.WriteCloser, <-chan error) {
@@ -22,6 +28,12 @@ func newWriteErrNotifier(w io.Writer) (io.WriteCloser, <-chan error) {
 }
 
 func (w *writeErrNotifier) Write(b []byte) (int, error) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+
 	n, err := w.w.Write(b)
 	if err != nil {
 		select {
@@ -36,6 +48,9 @@ func (w *writeErrNotifier) Write(b []byte) (int, error) {
 }
 
 func (w *writeErrNotifier) Close() error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	w.closed = true
 	select {
 	case w.errs <- io.EOF:
 	default:
@@ -47,10 +62,21 @@ func LogOption() ServeOption {
 	return func(_ API, _ *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
 		mux.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(200)
+			// let the client know the stream started, even if nothing is
+			// logged for a while
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
 			wnf, errs := newWriteErrNotifier(w)
+			// the writer group only drops writers once a write fails, so
+			// make sure ours does before w is handed back to the server
+			defer wnf.Close()
 			lwriter.WriterGroup.AddWriter(wnf)
 			log.Debugf("log API client connected")
-			<-errs
+			select {
+			case <-errs:
+			case <-serverShutdown(r.Context()):
+			}
 		})
 		return mux, nil
 	}
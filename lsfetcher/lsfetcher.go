@@ -0,0 +1,124 @@
+// Package lsfetcher implements a fetcher.Fetcher which loads blocks straight
+// from an ipld LinkSystem, for API implementations whose blocks are available
+// through the read storage of their sessions.
+package lsfetcher
+
+import (
+	"context"
+
+	"github.com/ipfs/go-fetcher"
+	"github.com/ipfs/go-unixfsnode"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/schema"
+	"github.com/ipld/go-ipld-prime/storage"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+)
+
+// Fetcher traverses dags by loading blocks through a LinkSystem. Loading a
+// block which is not in the LinkSystem's storage fails with the storage's
+// error, so fetching with it checks that the blocks are present.
+type Fetcher struct {
+	ls *ipld.LinkSystem
+}
+
+// New returns a fetcher loading blocks through ls. The NodeReifier of ls is
+// honoured, so that pathing can use ADLs such as unixfs.
+func New(ls *ipld.LinkSystem) *Fetcher {
+	return &Fetcher{ls: ls}
+}
+
+var _ fetcher.Fetcher = (*Fetcher)(nil)
+
+// NewLinkSystem returns a LinkSystem reading blocks from store, which knows
+// the unixfs ADL the gateway interprets UnixFS DAGs with.
+func NewLinkSystem(store storage.ReadableStorage) ipld.LinkSystem {
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.KnownReifiers = map[string]ipld.NodeReifier{
+		"unixfs": unixfsnode.Reify,
+	}
+	return ls
+}
+
+// BlockOfType loads the block behind link into a node of the given prototype.
+func (f *Fetcher) BlockOfType(ctx context.Context, link ipld.Link, nodePrototype ipld.NodePrototype) (ipld.Node, error) {
+	return f.ls.Load(ipld.LinkContext{Ctx: ctx}, link, nodePrototype)
+}
+
+// NodeMatching traverses the dag from root, calling cb for each node matched
+// by the selector. If root is a link, the block it points to is loaded first.
+func (f *Fetcher) NodeMatching(ctx context.Context, root ipld.Node, match ipld.Node, cb fetcher.FetchCallback) error {
+	if root.Kind() == datamodel.Kind_Link {
+		lnk, err := root.AsLink()
+		if err != nil {
+			return err
+		}
+		return f.BlockMatchingOfType(ctx, lnk, match, nil, cb)
+	}
+	return f.nodeMatching(ctx, f.progress(ctx), root, match, cb)
+}
+
+// BlockMatchingOfType loads the block behind root, and traverses the dag from
+// there, calling cb for each node matched by the selector.
+func (f *Fetcher) BlockMatchingOfType(ctx context.Context, root ipld.Link, match ipld.Node, _ ipld.NodePrototype, cb fetcher.FetchCallback) error {
+	proto, err := f.PrototypeFromLink(root)
+	if err != nil {
+		return err
+	}
+	node, err := f.BlockOfType(ctx, root, proto)
+	if err != nil {
+		return err
+	}
+
+	prog := f.progress(ctx)
+	prog.LastBlock.Link = root
+	return f.nodeMatching(ctx, prog, node, match, cb)
+}
+
+// PrototypeFromLink picks dagpb.Type.PBNode for dag-pb links, the prototype of
+// typed links, or basicnode.Prototype.Any.
+func (f *Fetcher) PrototypeFromLink(lnk ipld.Link) (ipld.NodePrototype, error) {
+	return prototypeChooser(lnk, ipld.LinkContext{})
+}
+
+func (f *Fetcher) nodeMatching(ctx context.Context, prog traversal.Progress, node ipld.Node, match ipld.Node, cb fetcher.FetchCallback) error {
+	sel, err := selector.ParseSelector(match)
+	if err != nil {
+		return err
+	}
+	return prog.WalkMatching(node, sel, func(p traversal.Progress, n ipld.Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return cb(fetcher.FetchResult{
+			Node:          n,
+			Path:          p.Path,
+			LastBlockPath: p.LastBlock.Path,
+			LastBlockLink: p.LastBlock.Link,
+		})
+	})
+}
+
+func (f *Fetcher) progress(ctx context.Context) traversal.Progress {
+	return traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     *f.ls,
+			LinkTargetNodePrototypeChooser: prototypeChooser,
+		},
+	}
+}
+
+// prototypeChooser decodes dag-pb blocks as typed PBNodes, which the unixfs
+// reifier requires.
+var prototypeChooser = dagpb.AddSupportToChooser(func(lnk ipld.Link, lnkCtx ipld.LinkContext) (ipld.NodePrototype, error) {
+	if tlnkNd, ok := lnkCtx.LinkNode.(schema.TypedLinkNode); ok {
+		return tlnkNd.LinkTargetNodePrototype(), nil
+	}
+	return basicnode.Prototype.Any, nil
+})
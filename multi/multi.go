@@ -0,0 +1,391 @@
+// Package multi implements a gateway API combining several backends, eg. a
+// local blockstore, then a remote node, then an archive. Blocks are loaded
+// from the first backend which has them, and requests can be routed to some
+// of the backends by namespace, host or CID codec.
+//
+// The backends serving a request are reported in X-Ipfs-Backend headers,
+// along with the ones which failed, eg. "local;not_found" then "remote".
+package multi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	logging "github.com/ipfs/go-log"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var log = logging.Logger("gateway/multi")
+
+// BackendHeader is the response header reporting the backends used.
+const BackendHeader = "X-Ipfs-Backend"
+
+// Results of the backend operations, in metrics and headers.
+const (
+	resultOK       = "ok"
+	resultNotFound = "not_found"
+	resultTimeout  = "timeout"
+	resultError    = "error"
+	// the backend returned the name unchanged, as APIs unable to resolve
+	// names do
+	resultUnsupported = "unsupported"
+)
+
+// errUnsupported reports a name resolution a backend doesn't support.
+var errUnsupported = errors.New("name resolution not supported")
+
+var backendRequestsMetric = newBackendRequestsMetric()
+
+func newBackendRequestsMetric() *prometheus.CounterVec {
+	counterMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ipfs",
+			Subsystem: "http",
+			Name:      "gw_backend_requests_total",
+			Help:      "The number of block loads and name resolutions by each backend, by result.",
+		},
+		[]string{"backend", "operation", "result"},
+	)
+	if err := prometheus.Register(counterMetric); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counterMetric = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			log.Errorf("failed to register ipfs_http_gw_backend_requests_total: %v", err)
+		}
+	}
+	return counterMetric
+}
+
+// Backend is one of the APIs combined by an API.
+type Backend struct {
+	// Name identifies the backend in routes, metrics and headers.
+	Name string
+	API  gateway.API
+	// Timeout bounds each block load and name resolution by the backend,
+	// after which the next backend is tried. Zero means no timeout.
+	Timeout time.Duration
+}
+
+// Route selects the backends serving some requests. Empty fields match all
+// requests.
+type Route struct {
+	// Namespaces of the requested content paths, eg. "ipns".
+	Namespaces []string
+	// Hosts the clients used to reach the gateway, eg. "example.com".
+	Hosts []string
+	// Codecs of the loaded blocks, eg. cid.DagProtobuf. Routes restricted to
+	// codecs don't apply to name resolutions.
+	Codecs []uint64
+
+	// Backends are the names of the backends to try, in order.
+	Backends []string
+}
+
+func (r *Route) matches(namespace, host string, codec uint64, hasCodec bool) bool {
+	if len(r.Namespaces) > 0 && !contains(r.Namespaces, namespace) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !contains(r.Hosts, host) {
+		return false
+	}
+	if len(r.Codecs) > 0 {
+		if !hasCodec {
+			return false
+		}
+		found := false
+		for _, c := range r.Codecs {
+			found = found || c == codec
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// API combines backends. Requests matching no route are served by all the
+// backends, tried in order.
+type API struct {
+	backends []Backend
+	byName   map[string]*Backend
+	routes   []Route
+}
+
+var (
+	_ gateway.API         = (*API)(nil)
+	_ gateway.TTLResolver = (*API)(nil)
+)
+
+// New returns an API trying the backends in order.
+func New(backends ...Backend) (*API, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backend provided")
+	}
+	a := &API{backends: backends, byName: make(map[string]*Backend)}
+	for i := range a.backends {
+		b := &a.backends[i]
+		if b.Name == "" || b.API == nil {
+			return nil, fmt.Errorf("backend %d: a name and an API are required", i)
+		}
+		if _, ok := a.byName[b.Name]; ok {
+			return nil, fmt.Errorf("duplicate backend %q", b.Name)
+		}
+		a.byName[b.Name] = b
+	}
+	return a, nil
+}
+
+// AddRoute adds a route, after the existing ones. The first route matching a
+// request selects its backends. It must not be called while serving.
+func (a *API) AddRoute(r Route) error {
+	if len(r.Backends) == 0 {
+		return fmt.Errorf("route without backends")
+	}
+	for _, name := range r.Backends {
+		if _, ok := a.byName[name]; !ok {
+			return fmt.Errorf("unknown backend %q", name)
+		}
+	}
+	a.routes = append(a.routes, r)
+	return nil
+}
+
+// route returns the backends serving a request with ctx, for a name or block
+// in namespace.
+func (a *API) route(ctx context.Context, namespace string, codec uint64, hasCodec bool) []*Backend {
+	host, _ := gateway.RequestHostFromContext(ctx)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, r := range a.routes {
+		if !r.matches(namespace, host, codec, hasCodec) {
+			continue
+		}
+		backends := make([]*Backend, len(r.Backends))
+		for i, name := range r.Backends {
+			backends[i] = a.byName[name]
+		}
+		return backends
+	}
+	backends := make([]*Backend, len(a.backends))
+	for i := range a.backends {
+		backends[i] = &a.backends[i]
+	}
+	return backends
+}
+
+// routeLoad returns the backends loading c for a request with ctx.
+func (a *API) routeLoad(ctx context.Context, c cid.Cid) []*Backend {
+	namespace := ""
+	if p, ok := gateway.ContentPathFromContext(ctx); ok {
+		namespace = p.Namespace()
+	}
+	return a.route(ctx, namespace, c.Prefix().Codec, true)
+}
+
+// RouteKey names the backends loading lnk for a request with ctx, so that
+// coalesce.API only shares loads between requests routed to the same ones.
+func (a *API) RouteKey(ctx context.Context, lnk ipld.Link) string {
+	cl, ok := lnk.(cidlink.Link)
+	if !ok {
+		return ""
+	}
+	backends := a.routeLoad(ctx, cl.Cid)
+	names := make([]string, len(backends))
+	for i, b := range backends {
+		names[i] = b.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// try calls fn for each backend until one succeeds, recording the results.
+// It returns errUnsupported if fn did so for all the backends.
+func (a *API) try(ctx context.Context, backends []*Backend, operation, what string, fn func(context.Context, *Backend) error) error {
+	var errs []string
+	notFound, unsupported := 0, 0
+	for _, b := range backends {
+		bctx, cancel := ctx, context.CancelFunc(func() {})
+		if b.Timeout > 0 {
+			bctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		}
+		err := fn(bctx, b)
+		timedOut := bctx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+
+		result := resultOK
+		switch {
+		case err == nil:
+		case timedOut:
+			result = resultTimeout
+		case err == errUnsupported:
+			result = resultUnsupported
+			unsupported++
+		case errors.Is(err, gateway.ErrNotFound):
+			result = resultNotFound
+			notFound++
+		default:
+			result = resultError
+		}
+		backendRequestsMetric.WithLabelValues(b.Name, operation, result).Inc()
+		if err == nil {
+			gateway.AddResponseHeader(ctx, BackendHeader, b.Name)
+			return nil
+		}
+		gateway.AddResponseHeader(ctx, BackendHeader, b.Name+";"+result)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Debugf("backend %s failed to %s %s: %s", b.Name, operation, what, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", b.Name, err))
+	}
+	if unsupported == len(backends) {
+		return errUnsupported
+	}
+	if notFound > 0 && notFound+unsupported == len(backends) {
+		return fmt.Errorf("%w: %s", gateway.ErrNotFound, what)
+	}
+	return fmt.Errorf("failed to %s %s: %s", operation, what, strings.Join(errs, "; "))
+}
+
+// NewSession returns a LinkSystem loading blocks from the backends routed to,
+// through sessions of theirs opened when first needed.
+func (a *API) NewSession(ctx context.Context) *ipld.LinkSystem {
+	s := &session{api: a, ctx: ctx, sessions: make(map[string]*ipld.LinkSystem)}
+	ls := lsfetcher.NewLinkSystem(s)
+	// blocks are verified by the session
+	ls.TrustedStorage = true
+	return &ls
+}
+
+// FetcherForSession returns a fetcher loading the blocks of the traversed
+// DAGs one at a time, from the backends routed to. The fetchers of the
+// backends are not used.
+func (a *API) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+// Resolve resolves name with the backends routed to, in order. Backends
+// returning the name unchanged don't support resolving it, and the next one
+// is tried. The name is returned unchanged if no backend supports it.
+func (a *API) Resolve(ctx context.Context, name string) (string, error) {
+	resolved, _, err := a.ResolveTTL(ctx, name)
+	return resolved, err
+}
+
+// ResolveTTL is Resolve, which also returns the TTL of the resolution given
+// by the backend which resolved the name.
+func (a *API) ResolveTTL(ctx context.Context, name string) (string, time.Duration, error) {
+	namespace := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)[0]
+	var resolved string
+	var ttl time.Duration
+	err := a.try(ctx, a.route(ctx, namespace, 0, false), "resolve", name, func(ctx context.Context, b *Backend) error {
+		var err error
+		resolved, ttl, err = gateway.ResolveNameTTL(ctx, b.API, name)
+		if err == nil && resolved == name {
+			return errUnsupported
+		}
+		return err
+	})
+	if err == errUnsupported {
+		return name, 0, nil
+	}
+	return resolved, ttl, err
+}
+
+// session loads the blocks of a request from the backends, and implements
+// the read storage of its LinkSystem.
+type session struct {
+	api *API
+	ctx context.Context
+
+	mu       sync.Mutex
+	sessions map[string]*ipld.LinkSystem
+}
+
+// backendSession returns the session of the backend for the request.
+func (s *session) backendSession(b *Backend) *ipld.LinkSystem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ls, ok := s.sessions[b.Name]
+	if !ok {
+		ls = b.API.NewSession(s.ctx)
+		s.sessions[b.Name] = ls
+	}
+	return ls
+}
+
+func (s *session) Has(ctx context.Context, key string) (bool, error) {
+	if _, err := s.Get(ctx, key); err != nil {
+		if errors.Is(err, gateway.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Get loads the block from the first backend routed to which has it.
+func (s *session) Get(ctx context.Context, key string) ([]byte, error) {
+	c, err := cid.Cast([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if ctx == nil {
+		ctx = s.ctx
+	}
+
+	var data []byte
+	err = s.api.try(ctx, s.api.routeLoad(ctx, c), "load", c.String(), func(ctx context.Context, b *Backend) error {
+		ls := s.backendSession(b)
+		r, err := ls.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+		if err != nil {
+			return err
+		}
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if !ls.TrustedStorage {
+			// a corrupted block is a failure of this backend only
+			if err := verify(c, d); err != nil {
+				return err
+			}
+		}
+		data = d
+		return nil
+	})
+	return data, err
+}
+
+// verify checks that data hashes to c.
+func verify(c cid.Cid, data []byte) error {
+	hashed, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !hashed.Equals(c) {
+		return fmt.Errorf("block does not match its CID: expected %s, got %s", c, hashed)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package multi
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+)
+
+// testAPI serves the blocks of a memstore after a delay, and resolves names
+// to the given path. Like the real APIs, it returns names unchanged when it
+// has no resolution.
+type testAPI struct {
+	store    *memstore.Store
+	delay    time.Duration
+	resolved string
+}
+
+func (a *testAPI) NewSession(context.Context) *ipld.LinkSystem {
+	ls := lsfetcher.NewLinkSystem(a)
+	return &ls
+}
+
+func (a *testAPI) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+func (a *testAPI) Resolve(ctx context.Context, name string) (string, error) {
+	if a.resolved == "" {
+		return name, nil
+	}
+	return a.resolved, nil
+}
+
+func (a *testAPI) Has(ctx context.Context, key string) (bool, error) {
+	return a.store.Has(ctx, key)
+}
+
+func (a *testAPI) Get(ctx context.Context, key string) ([]byte, error) {
+	select {
+	case <-time.After(a.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	data, err := a.store.Get(ctx, key)
+	if err != nil {
+		return nil, gateway.ErrNotFound
+	}
+	return data, nil
+}
+
+// newTestAPIs returns a UnixFS directory holding hello.txt, whose blocks are
+// split between a first API holding the directory, and a second one holding
+// the file.
+func newTestAPIs(t *testing.T) (dir, file *testAPI, root cid.Cid) {
+	t.Helper()
+	dir = &testAPI{store: &memstore.Store{Bag: map[string][]byte{}}}
+	file = &testAPI{store: &memstore.Store{Bag: map[string][]byte{}}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(file.store)
+	ls.SetWriteStorage(file.store)
+	lnk, size, err := builder.BuildUnixFSFile(strings.NewReader("hello world"), "", &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := builder.BuildUnixFSDirectoryEntry("hello.txt", int64(size), lnk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls.SetWriteStorage(dir.store)
+	rootLnk, _, err := builder.BuildUnixFSDirectory([]dagpb.PBLink{entry}, &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, file, rootLnk.(cidlink.Link).Cid
+}
+
+func serve(t *testing.T, api gateway.API) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gateway.Serve(api, &gateway.GatewayConfig{}, l, gateway.GatewayOption("/ipfs", "/ipns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return "http://" + s.Addrs()[0].String()
+}
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+func hasValue(values []string, v string) bool {
+	for _, e := range values {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFailover(t *testing.T) {
+	dir, file, root := newTestAPIs(t)
+	slow := &testAPI{store: file.store, delay: time.Minute}
+	api, err := New(
+		Backend{Name: "local", API: dir},
+		Backend{Name: "slow", API: slow, Timeout: 50 * time.Millisecond},
+		Backend{Name: "archive", API: file},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := serve(t, api)
+
+	res, body := get(t, url+"/ipfs/"+root.String()+"/hello.txt")
+	if res.StatusCode != http.StatusOK || body != "hello world" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+	backends := res.Header.Values(BackendHeader)
+	for _, v := range []string{"local", "local;not_found", "slow;timeout", "archive"} {
+		if !hasValue(backends, v) {
+			t.Errorf("expected %s in %v", v, backends)
+		}
+	}
+
+	// a backend timing out doesn't mean the block is missing
+	missing := "bafkreie7q3iidccmpvszul7kudcvvuavuo7u6gzlbobczuk5nqk3b4akba"
+	if res, _ := get(t, url+"/ipfs/"+missing+"?format=raw"); res.StatusCode == http.StatusOK || res.StatusCode == http.StatusNotFound {
+		t.Fatalf("expected an error, got %d", res.StatusCode)
+	}
+
+	api, err = New(Backend{Name: "local", API: dir}, Backend{Name: "archive", API: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url = serve(t, api)
+	if res, _ := get(t, url+"/ipfs/"+missing+"?format=raw"); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected blocks missing from all backends to be 404, got %d", res.StatusCode)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	dir, file, root := newTestAPIs(t)
+	file.resolved = "/ipfs/" + root.String()
+	api, err := New(
+		Backend{Name: "dirs", API: dir},
+		Backend{Name: "files", API: file},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first matching route applies
+	if err := api.AddRoute(Route{Hosts: []string{"dirs.example.com"}, Backends: []string{"dirs"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddRoute(Route{Codecs: []uint64{cid.Raw}, Backends: []string{"files"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddRoute(Route{Namespaces: []string{"ipns"}, Backends: []string{"files", "dirs"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddRoute(Route{Backends: []string{"nope"}}); err == nil {
+		t.Fatal("expected routes to unknown backends to be rejected")
+	}
+
+	// the raw file block goes straight to the files backend
+	url := serve(t, api)
+	res, body := get(t, url+"/ipfs/"+root.String()+"/hello.txt")
+	if res.StatusCode != http.StatusOK || body != "hello world" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+	if backends := res.Header.Values(BackendHeader); hasValue(backends, "dirs;not_found") {
+		t.Fatalf("expected raw blocks to be routed to the files backend, got %v", backends)
+	}
+
+	// names are resolved by the backends routed to
+	p, err := api.Resolve(context.Background(), "/ipns/example.com")
+	if err != nil || p != file.resolved {
+		t.Fatalf("unexpected resolution %q (%v)", p, err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url+"/ipfs/"+root.String()+"/hello.txt", nil)
+	req.Host = "dirs.example.com"
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound || !hasValue(res.Header.Values(BackendHeader), "dirs;not_found") {
+		t.Fatalf("expected the host to be served by the dirs backend only, got %d %v", res.StatusCode, res.Header.Values(BackendHeader))
+	}
+
+	// outside of requests, routes by host don't apply
+	ls := api.NewSession(context.Background())
+	if _, err := ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: root}, basicnode.Prototype.Any); err != nil {
+		t.Fatal(err)
+	}
+
+	// the route keys of coalesce name the backends routed to
+	if key := api.RouteKey(context.Background(), cidlink.Link{Cid: root}); key != "dirs,files" {
+		t.Fatalf("unexpected route key %q", key)
+	}
+	raw := cid.NewCidV1(cid.Raw, root.Hash())
+	if key := api.RouteKey(context.Background(), cidlink.Link{Cid: raw}); key != "files" {
+		t.Fatalf("unexpected route key %q for raw blocks", key)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(); err == nil {
+		t.Fatal("expected an error without backends")
+	}
+	a := &testAPI{}
+	if _, err := New(Backend{Name: "a", API: a}, Backend{Name: "a", API: a}); err == nil {
+		t.Fatal("expected duplicate backends to be rejected")
+	}
+	api, _ := New(Backend{Name: "a", API: a})
+	if p, err := api.Resolve(context.Background(), "/ipns/example.com"); err != nil || p != "/ipns/example.com" {
+		t.Fatalf("expected names no backend resolves to be returned unchanged, got %q (%v)", p, err)
+	}
+}
+
+func TestResolveSkipsUnsupported(t *testing.T) {
+	dir, file, root := newTestAPIs(t)
+	file.resolved = "/ipfs/" + root.String()
+	api, err := New(
+		Backend{Name: "dirs", API: dir},
+		Backend{Name: "files", API: file},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dirs returns the name unchanged, so files gets to resolve it
+	p, ttl, err := api.ResolveTTL(context.Background(), "/ipns/example.com")
+	if err != nil || p != file.resolved {
+		t.Fatalf("expected the name to be resolved by the second backend, got %q (%v)", p, err)
+	}
+	if ttl != gateway.DefaultNameTTL {
+		t.Fatalf("expected the default TTL of backends without one, got %s", ttl)
+	}
+}
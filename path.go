@@ -4,12 +4,19 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-fetcher"
+	fetcherhelpers "github.com/ipfs/go-fetcher/helpers"
 	ipfspath "github.com/ipfs/go-path"
 	resolver "github.com/ipfs/go-path/resolver"
 	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/schema"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
 )
 
 // from interface-go-ipfs-core/path
@@ -104,6 +111,20 @@ type Resolved interface {
 	// For more examples see the documentation of Cid() method
 	Remainder() string
 
+	// Segments returns the CIDs the path resolved to after each of its
+	// segments, in order, starting with the root. The CID of a segment is the
+	// one its link points to, or the one of the block holding it when it
+	// isn't a link.
+	//
+	// Example:
+	// If you have 3 linked objects: QmRoot -> A -> B, and resolve path
+	// "/ipfs/QmRoot/A/B", the Segments method will return the CIDs of QmRoot,
+	// A and B.
+	//
+	// It returns nil for paths whose segments were not recorded, such as the
+	// ones created with NewResolvedPath.
+	Segments() []cid.Cid
+
 	Path
 }
 
@@ -118,6 +139,7 @@ type resolvedPath struct {
 	cid       cid.Cid
 	root      cid.Cid
 	remainder string
+	segments  []cid.Cid
 }
 
 // Join appends provided segments to the base path
@@ -133,6 +155,7 @@ func IpfsPath(c cid.Cid) Resolved {
 		cid:       c,
 		root:      c,
 		remainder: "",
+		segments:  []cid.Cid{c},
 	}
 }
 
@@ -143,6 +166,7 @@ func IpldPath(c cid.Cid) Resolved {
 		cid:       c,
 		root:      c,
 		remainder: "",
+		segments:  []cid.Cid{c},
 	}
 }
 
@@ -205,6 +229,10 @@ func (p *resolvedPath) Remainder() string {
 	return p.remainder
 }
 
+func (p *resolvedPath) Segments() []cid.Cid {
+	return p.segments
+}
+
 type factory struct {
 	a    API
 	mode string
@@ -218,26 +246,59 @@ func (f *factory) NewSession(ctx context.Context) fetcher.Fetcher {
 	return f.a.FetcherForSession(ls)
 }
 
+// maxNameResolutions bounds the chains of names resolving to other names.
+const maxNameResolutions = 32
+
+// DefaultNameTTL is how long the name resolutions of APIs which are not
+// TTLResolvers stay valid.
+const DefaultNameTTL = time.Minute
+
+// ResolvePath resolves p to its final DAG node. The /ipns names in p are
+// resolved first, with the Resolve method of a: names it returns unchanged
+// can't be resolved, and fail.
 func ResolvePath(ctx context.Context, a API, p Path) (Resolved, error) {
+	resolved, _, err := resolvePathTTL(ctx, a, p)
+	return resolved, err
+}
+
+// resolvePathTTL is ResolvePath, which also returns the smallest TTL of the
+// names resolved on the way, if any.
+func resolvePathTTL(ctx context.Context, a API, p Path) (Resolved, time.Duration, error) {
 	if _, ok := p.(Resolved); ok {
-		return p.(Resolved), nil
+		return p.(Resolved), 0, nil
 	}
 	if err := p.IsValid(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	ipath := ipfspath.Path(p.String())
-	/* //todo: ipns
-	ipath, err := resolve.ResolveIPNS(ctx, api.namesys, ipath)
-	if err == resolve.ErrNoNamesys {
-		return nil, coreiface.ErrOffline
-	} else if err != nil {
-		return nil, err
+	depth := len(ipath.Segments()) - 1
+	var ttl time.Duration
+	for n := 0; ipath.Segments()[0] == "ipns"; n++ {
+		if n == maxNameResolutions {
+			return nil, 0, fmt.Errorf("could not resolve %s: recursion limit exceeded", p)
+		}
+		segments := ipath.Segments()
+		name := "/ipns/" + segments[1]
+		value, nameTTL, err := ResolveNameTTL(ctx, a, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if value == name {
+			return nil, 0, fmt.Errorf("could not resolve name %s", name)
+		}
+		if n == 0 || nameTTL < ttl {
+			ttl = nameTTL
+		}
+		target, err := ipfspath.ParsePath(value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s resolved to an invalid path: %w", name, err)
+		}
+		ipath = ipfspath.Path(ipfspath.Join(append([]string{target.String()}, segments[2:]...)))
 	}
-	*/
 
 	if ipath.Segments()[0] != "ipfs" && ipath.Segments()[0] != "ipld" {
-		return nil, fmt.Errorf("unsupported path namespace: %s", p.Namespace())
+		return nil, 0, fmt.Errorf("unsupported path namespace: %s", p.Namespace())
 	}
 
 	dataFetcher := &factory{a, ""}
@@ -246,17 +307,116 @@ func ResolvePath(ctx context.Context, a API, p Path) (Resolved, error) {
 	} else {
 		dataFetcher.mode = "unixfs"
 	}
-	resolver := resolver.NewBasicResolver(dataFetcher)
+	c, segments, rest, err := resolveSegments(ctx, dataFetcher, ipath)
+	if err != nil {
+		return nil, 0, err
+	}
+	root := segments[0]
+	if len(segments) > depth {
+		// the segments of a name are the ones of the path it resolved to
+		segments = segments[len(segments)-depth:]
+	}
 
-	node, rest, err := resolver.ResolveToLastNode(ctx, ipath)
+	return &resolvedPath{
+		pathImpl:  pathImpl{ipath.String()},
+		cid:       c,
+		root:      root,
+		remainder: ipfspath.Join(rest),
+		segments:  segments,
+	}, ttl, nil
+}
+
+// ResolveNameTTL resolves name with a, along with the time the resolution
+// stays valid for: the one returned by TTLResolvers, DefaultNameTTL for the
+// other APIs. API decorators implement TTLResolver with it.
+func ResolveNameTTL(ctx context.Context, a API, name string) (string, time.Duration, error) {
+	if r, ok := a.(TTLResolver); ok {
+		return r.ResolveTTL(ctx, name)
+	}
+	value, err := a.Resolve(ctx, name)
+	return value, DefaultNameTTL, err
+}
+
+// resolveSegments is resolver.ResolveToLastNode, which also returns the CID
+// of every segment of the path, in a single walk.
+func resolveSegments(ctx context.Context, f fetcher.Factory, fpath ipfspath.Path) (cid.Cid, []cid.Cid, []string, error) {
+	c, p, err := ipfspath.SplitAbsPath(fpath)
+	if err != nil {
+		return cid.Undef, nil, nil, err
+	}
+	if len(p) == 0 {
+		return c, []cid.Cid{c}, nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	// match the root and the nodes of all the segments but the last, and
+	// record the block each of them was found in
+	var nodes []ipld.Node
+	var segments []cid.Cid
+	lastCid, depth := cid.Undef, 0
+	session := f.NewSession(ctx)
+	err = fetcherhelpers.BlockMatching(ctx, session, cidlink.Link{Cid: c}, pathAllSelector(p[:len(p)-1]), func(res fetcher.FetchResult) error {
+		blockCid := c
+		if res.LastBlockLink != nil {
+			cl, ok := res.LastBlockLink.(cidlink.Link)
+			if !ok {
+				return fmt.Errorf("link is not a cidlink: %v", res.LastBlockLink)
+			}
+			blockCid = cl.Cid
+		}
+		if blockCid.Equals(lastCid) {
+			depth++
+		} else {
+			lastCid, depth = blockCid, 0
+		}
+		nodes = append(nodes, res.Node)
+		segments = append(segments, blockCid)
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return cid.Undef, nil, nil, err
+	}
+	if len(nodes) < 1 {
+		return cid.Undef, nil, nil, fmt.Errorf("path %v did not resolve to a node", fpath)
+	} else if len(nodes) < len(p) {
+		return cid.Undef, nil, nil, resolver.ErrNoLink{Name: p[len(nodes)-1], Node: lastCid}
 	}
 
-	root, err := cid.Parse(ipath.Segments()[1])
+	// the last segment is not loaded
+	lastSegment := p[len(p)-1]
+	nd, err := nodes[len(nodes)-1].LookupBySegment(ipld.ParsePathSegment(lastSegment))
+	switch err.(type) {
+	case nil:
+	case schema.ErrNoSuchField:
+		return cid.Undef, nil, nil, resolver.ErrNoLink{Name: lastSegment, Node: lastCid}
+	default:
+		return cid.Undef, nil, nil, err
+	}
+	if nd.Kind() != ipld.Kind_Link {
+		return lastCid, append(segments, lastCid), p[len(p)-depth-1:], nil
+	}
+	lnk, err := nd.AsLink()
 	if err != nil {
-		return nil, err
+		return cid.Undef, nil, nil, err
+	}
+	cl, ok := lnk.(cidlink.Link)
+	if !ok {
+		return cid.Undef, nil, nil, fmt.Errorf("path %v resolves to a link that is not a cid link: %v", fpath, lnk)
 	}
+	return cl.Cid, append(segments, cl.Cid), []string{}, nil
+}
 
-	return NewResolvedPath(ipath, node, root, ipfspath.Join(rest)), nil
+// pathAllSelector matches the root and the node of every segment of path.
+func pathAllSelector(path []string) ipld.Node {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	spec := ssb.Matcher()
+	for i := len(path) - 1; i >= 0; i-- {
+		spec = ssb.ExploreUnion(
+			ssb.Matcher(),
+			ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) { efsb.Insert(path[i], spec) }),
+		)
+	}
+	return spec.Node()
 }
@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ipfspath "github.com/ipfs/go-path"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+)
+
+func TestResolvePathSegments(t *testing.T) {
+	a := &latencyAPI{store: &memstore.Store{Bag: map[string][]byte{}}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(a.store)
+	ls.SetWriteStorage(a.store)
+
+	// /a/b/c/hello.txt, CIDs from hello.txt up to the root
+	lnk, size, err := builder.BuildUnixFSFile(strings.NewReader("hello"), "", &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids := []cid.Cid{lnk.(cidlink.Link).Cid}
+	for _, name := range []string{"hello.txt", "c", "b", "a"} {
+		entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), lnk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lnk, size, err = builder.BuildUnixFSDirectory([]dagpb.PBLink{entry}, &ls); err != nil {
+			t.Fatal(err)
+		}
+		cids = append([]cid.Cid{lnk.(cidlink.Link).Cid}, cids...)
+	}
+	root := cids[0]
+
+	ctx := context.Background()
+	for _, test := range []struct {
+		path     string
+		segments int
+	}{
+		{"/ipfs/" + root.String(), 1},
+		{"/ipfs/" + root.String() + "/", 1},
+		{"/ipfs/" + root.String() + "/a/b", 3},
+		{"/ipfs/" + root.String() + "/a/b/c/hello.txt", 5},
+	} {
+		p, expected := test.path, cids[:test.segments]
+		resolved, err := ResolvePath(ctx, a, NewPath(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments := resolved.Segments()
+		if len(segments) != len(expected) {
+			t.Fatalf("%s: expected %v, got %v", p, expected, segments)
+		}
+		for i := range expected {
+			if !segments[i].Equals(expected[i]) {
+				t.Fatalf("%s: expected %v, got %v", p, expected, segments)
+			}
+		}
+		if !resolved.Root().Equals(root) || !resolved.Cid().Equals(segments[len(segments)-1]) {
+			t.Fatalf("%s: unexpected resolution to %s from %s", p, resolved.Cid(), resolved.Root())
+		}
+	}
+
+	if _, err := ResolvePath(ctx, a, NewPath("/ipfs/"+root.String()+"/a/nope/c")); err == nil {
+		t.Fatal("expected missing segments to fail")
+	}
+	if segments := NewResolvedPath(ipfspath.Path("/ipfs/"+root.String()), root, root, "").Segments(); segments != nil {
+		t.Fatalf("expected paths created by NewResolvedPath to have no segments, got %v", segments)
+	}
+
+	// X-Ipfs-Roots lists them
+	url := readAheadServer(t, a, 0).URL + "/ipfs/" + root.String() + "/a/b/c/hello.txt"
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	var roots []string
+	for _, c := range cids {
+		roots = append(roots, c.String())
+	}
+	if got := res.Header.Get("X-Ipfs-Roots"); got != strings.Join(roots, ",") {
+		t.Fatalf("unexpected X-Ipfs-Roots %q", got)
+	}
+}
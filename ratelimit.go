@@ -0,0 +1,254 @@
+package gateway
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RateLimitConfig configures RateLimitOption.
+type RateLimitConfig struct {
+	// RequestsPerSecond is the sustained rate of requests allowed from a
+	// single client IP. Zero disables per-client rate limiting.
+	RequestsPerSecond float64
+
+	// Burst is the number of requests a client can make at once before
+	// being limited to RequestsPerSecond. Defaults to 1.
+	Burst int
+
+	// MaxInFlight is the maximum number of requests handled concurrently,
+	// across all clients. Zero means no limit.
+	MaxInFlight int
+
+	// TrustedProxies is a list of IPs or CIDRs of reverse proxies. Only
+	// requests coming from these are allowed to set the client IP through
+	// the Forwarded or X-Forwarded-For headers. Defaults to
+	// GatewayConfig.TrustedProxies.
+	TrustedProxies []string
+}
+
+// Period after which state about idle clients is dropped.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitOption limits the rate of requests per client IP, and the number
+// of requests handled concurrently. Clients over their rate get HTTP 429 Too
+// Many Requests with a Retry-After header, and requests over the concurrency
+// cap get HTTP 503 Service Unavailable.
+func RateLimitOption(cfg RateLimitConfig) ServeOption {
+	return func(_ API, gc *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		trusted := cfg.TrustedProxies
+		if len(trusted) == 0 && gc != nil {
+			trusted = gc.TrustedProxies
+		}
+		proxies, err := parseTrustedProxies(trusted)
+		if err != nil {
+			return nil, err
+		}
+
+		rejected := prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ipfs",
+				Subsystem: "http",
+				Name:      "requests_rejected_total",
+				Help:      "Total number of HTTP requests rejected by rate limiting.",
+			},
+			[]string{"reason"},
+		)
+		if err := prometheus.Register(rejected); err != nil {
+			if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				rejected = are.ExistingCollector.(*prometheus.CounterVec)
+			} else {
+				return nil, err
+			}
+		}
+
+		inFlight := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ipfs",
+			Subsystem: "http",
+			Name:      "requests_in_flight",
+			Help:      "The number of HTTP requests currently being handled.",
+		})
+		if err := prometheus.Register(inFlight); err != nil {
+			if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				inFlight = are.ExistingCollector.(prometheus.Gauge)
+			} else {
+				return nil, err
+			}
+		}
+
+		var limiter *clientRateLimiter
+		if cfg.RequestsPerSecond > 0 {
+			limiter = newClientRateLimiter(cfg.RequestsPerSecond, cfg.Burst)
+		}
+		var slots chan struct{}
+		if cfg.MaxInFlight > 0 {
+			slots = make(chan struct{}, cfg.MaxInFlight)
+		}
+
+		childMux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if limiter != nil {
+				if wait, ok := limiter.allow(clientIP(r, proxies), time.Now()); !ok {
+					rejected.WithLabelValues("rate_limit").Inc()
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					http.Error(w, "too many requests", http.StatusTooManyRequests)
+					return
+				}
+			}
+
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				default:
+					rejected.WithLabelValues("concurrency").Inc()
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+					return
+				}
+			}
+
+			inFlight.Inc()
+			defer inFlight.Dec()
+			childMux.ServeHTTP(w, r)
+		})
+		return childMux, nil
+	}
+}
+
+// clientRateLimiter is a set of token buckets, one per client.
+type clientRateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64 // bucket capacity
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newClientRateLimiter(rate float64, burst int) *clientRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &clientRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the client's bucket. If none is available, it
+// returns how long the client should wait before trying again.
+func (l *clientRateLimiter) allow(client string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+}
+
+// sweep drops buckets which have been refilled to capacity, as they are
+// indistinguishable from new ones.
+func (l *clientRateLimiter) sweep(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// parseTrustedProxies parses a list of IPs and CIDRs.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR %q: %w", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP, proxies []*net.IPNet) bool {
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client which made the request. The
+// Forwarded and X-Forwarded-For headers are only taken into account when the
+// request comes from a trusted proxy, in which case the right-most address
+// that is not a trusted proxy is used.
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	remote := stripPort(r.RemoteAddr)
+	ip := net.ParseIP(remote)
+	if ip == nil || !isTrustedProxy(ip, proxies) {
+		return remote
+	}
+
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		if ip := forwardedNodeIP(outermostForwarded(parseForwarded(fwd), proxies)["for"]); ip != nil {
+			return ip.String()
+		}
+		return remote
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break
+		}
+		if !isTrustedProxy(hopIP, proxies) {
+			return hop
+		}
+		remote = hop
+	}
+	return remote
+}
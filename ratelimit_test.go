@@ -0,0 +1,139 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		remote    string
+		xff       string
+		forwarded string
+		out       string
+	}{
+		{"1.2.3.4:1234", "", "", "1.2.3.4"},
+		{"1.2.3.4:1234", "5.6.7.8", "", "1.2.3.4"}, // untrusted peer can't spoof
+		{"10.1.2.3:1234", "5.6.7.8", "", "5.6.7.8"},
+		{"10.1.2.3:1234", "9.9.9.9, 5.6.7.8, 192.168.1.1", "", "5.6.7.8"},
+		{"10.1.2.3:1234", "10.0.0.1", "", "10.0.0.1"},
+		{"10.1.2.3:1234", "garbage", "", "10.1.2.3"},
+		{"[::1]:1234", "5.6.7.8", "", "::1"},
+		{"10.1.2.3:1234", "", "for=5.6.7.8", "5.6.7.8"},
+		{"10.1.2.3:1234", "", `for=9.9.9.9, for="[2001:db8::1]:80", for=192.168.1.1`, "2001:db8::1"},
+		{"10.1.2.3:1234", "", "for=unknown", "10.1.2.3"},
+		{"10.1.2.3:1234", "1.1.1.1", "for=5.6.7.8", "5.6.7.8"}, // Forwarded wins
+		{"1.2.3.4:1234", "", "for=5.6.7.8", "1.2.3.4"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remote
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if test.forwarded != "" {
+			r.Header.Set("Forwarded", test.forwarded)
+		}
+		if out := clientIP(r, proxies); out != test.out {
+			t.Errorf("clientIP(%s, %q, %q) = %s, expected %s", test.remote, test.xff, test.forwarded, out, test.out)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Error("expected an error for an invalid trusted proxy")
+	}
+}
+
+func TestClientRateLimiter(t *testing.T) {
+	l := newClientRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if _, ok := l.allow("a", now); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+	wait, ok := l.allow("a", now)
+	if ok {
+		t.Fatal("request over burst was not limited")
+	}
+	if wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %s", wait)
+	}
+	if _, ok := l.allow("b", now); !ok {
+		t.Fatal("other client was limited")
+	}
+	if _, ok := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Fatal("request after refill was limited")
+	}
+
+	l.allow("a", now.Add(time.Hour))
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected idle buckets to be swept, got %d", len(l.buckets))
+	}
+}
+
+func TestRateLimitOption(t *testing.T) {
+	release := make(chan struct{})
+	root := http.NewServeMux()
+	mux, err := RateLimitOption(RateLimitConfig{
+		RequestsPerSecond: 1,
+		Burst:             2,
+		MaxInFlight:       1,
+	})(nil, nil, nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	})
+
+	request := func(path, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		root.ServeHTTP(w, r)
+		return w
+	}
+
+	// concurrency cap
+	done := make(chan struct{})
+	go func() {
+		request("/slow", "1.1.1.1:1")
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	var w *httptest.ResponseRecorder
+	for i := 0; time.Now().Before(deadline); i++ {
+		// a different client each time, so we never hit the rate limit
+		if w = request("/", fmt.Sprintf("2.2.%d.%d:1", i/256%256, i%256)); w.Code == http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while a request is in flight, got %d", w.Code)
+	}
+	close(release)
+	<-done
+
+	// per-client rate
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := request("/", "3.3.3.3:1")
+		if w.Code != expected {
+			t.Fatalf("request %d: got %d, expected %d", i, w.Code, expected)
+		}
+		if expected == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Fatalf("expected Retry-After: 1, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// defaultReadAheadBlocks is the read-ahead window used when
+// GatewayConfig.ReadAheadBlocks is zero.
+const defaultReadAheadBlocks = 8
+
+// readAhead loads the blocks of the UnixFS files read through a LinkSystem
+// before the reader gets to them.
+//
+// The UnixFS file reader loads the blocks of a file one at a time, in order,
+// so streaming a large file from a remote backend takes one round trip per
+// block. readAhead learns the children of the file nodes loaded, and whenever
+// one of them is loaded, starts loading the next siblings in parallel. Since
+// it only relies on the loads, it follows the reader wherever it seeks, eg.
+// for range requests.
+type readAhead struct {
+	ctx    context.Context
+	load   func(ipld.LinkContext, ipld.Link) (io.Reader, error)
+	window int
+	// the LinkSystem loading through open
+	ls ipld.LinkSystem
+
+	mu sync.Mutex
+	// children of the file nodes loaded, by key
+	children map[string][]ipld.Link
+	// parent and index of the children of the file nodes loaded, by key
+	positions map[string]position
+	// blocks being read ahead, by key
+	pending map[string]*pendingBlock
+}
+
+type position struct {
+	parent string
+	index  int
+}
+
+type pendingBlock struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	data   []byte
+	err    error
+}
+
+// withReadAhead returns a copy of ls whose loads read up to window blocks
+// ahead, until ctx is done. A zero window uses the default, a negative one
+// disables read-ahead. ls itself is left as is, since APIs may return the same
+// LinkSystem to every session.
+func withReadAhead(ctx context.Context, ls *ipld.LinkSystem, window int) *ipld.LinkSystem {
+	if window == 0 {
+		window = defaultReadAheadBlocks
+	}
+	if window < 0 || ls.StorageReadOpener == nil {
+		return ls
+	}
+	ra := &readAhead{
+		ctx:       ctx,
+		load:      ls.StorageReadOpener,
+		window:    window,
+		children:  make(map[string][]ipld.Link),
+		positions: make(map[string]position),
+		pending:   make(map[string]*pendingBlock),
+	}
+	ra.ls = *ls
+	ra.ls.StorageReadOpener = ra.open
+	return &ra.ls
+}
+
+func (ra *readAhead) open(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	key := lnk.Binary()
+	ra.mu.Lock()
+	p, ok := ra.pending[key]
+	delete(ra.pending, key)
+	if !ok {
+		if _, known := ra.positions[key]; known {
+			// the reader moved elsewhere in the file, eg. to serve a
+			// range, the blocks read ahead won't be used
+			ra.cancelPendingLocked()
+		}
+	}
+	ra.mu.Unlock()
+
+	if lctx.Ctx == nil {
+		lctx.Ctx = ra.ctx
+	}
+	var blk []byte
+	var err error
+	if ok {
+		select {
+		case <-p.done:
+			blk, err = p.data, p.err
+		case <-lctx.Ctx.Done():
+			p.cancel()
+			return nil, lctx.Ctx.Err()
+		}
+	}
+	if !ok || err != nil {
+		blk, err = ra.loadBlock(lctx, lnk)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ra.loaded(key, lnk, blk)
+	return bytes.NewReader(blk), nil
+}
+
+func (ra *readAhead) loadBlock(lctx ipld.LinkContext, lnk ipld.Link) ([]byte, error) {
+	r, err := ra.load(lctx, lnk)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// loaded records the children of the file node with key, and reads ahead
+// after it.
+func (ra *readAhead) loaded(key string, lnk ipld.Link, blk []byte) {
+	links := fileLinks(lnk, blk)
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if len(links) > 0 {
+		if _, ok := ra.children[key]; !ok {
+			ra.children[key] = links
+			for i, l := range links {
+				ra.positions[l.Binary()] = position{parent: key, index: i}
+			}
+		}
+		if _, ok := ra.positions[key]; ok {
+			// the reader is about to go through the children of this
+			// intermediate node
+			ra.prefetchLocked(links)
+		}
+	}
+	// then the siblings of the node and of its parents, the closest first
+	for pos, ok := ra.positions[key]; ok; pos, ok = ra.positions[pos.parent] {
+		ra.prefetchLocked(ra.children[pos.parent][pos.index+1:])
+	}
+}
+
+// prefetchLocked starts loading links in order, as long as the window has
+// room.
+func (ra *readAhead) prefetchLocked(links []ipld.Link) {
+	for _, l := range links {
+		if len(ra.pending) >= ra.window || ra.ctx.Err() != nil {
+			return
+		}
+		key := l.Binary()
+		if _, ok := ra.pending[key]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(ra.ctx)
+		p := &pendingBlock{done: make(chan struct{}), cancel: cancel}
+		ra.pending[key] = p
+		go func(l ipld.Link) {
+			defer cancel()
+			p.data, p.err = ra.loadBlock(ipld.LinkContext{Ctx: ctx}, l)
+			close(p.done)
+		}(l)
+	}
+}
+
+func (ra *readAhead) cancelPendingLocked() {
+	for key, p := range ra.pending {
+		p.cancel()
+		delete(ra.pending, key)
+	}
+}
+
+// fileLinks returns the links to the children of blk, if it is a UnixFS file
+// node.
+func fileLinks(lnk ipld.Link, blk []byte) []ipld.Link {
+	cl, ok := lnk.(cidlink.Link)
+	if !ok || cl.Cid.Prefix().Codec != cid.DagProtobuf {
+		return nil
+	}
+	nb := dagpb.Type.PBNode.NewBuilder()
+	if err := dagpb.DecodeBytes(nb, blk); err != nil {
+		return nil
+	}
+	node := nb.Build().(dagpb.PBNode)
+	if !node.FieldData().Exists() || node.FieldLinks().Length() == 0 {
+		return nil
+	}
+	ud, err := data.DecodeUnixFSData(node.FieldData().Must().Bytes())
+	if err != nil || ud.FieldDataType().Int() != data.Data_File {
+		return nil
+	}
+	links := make([]ipld.Link, 0, node.FieldLinks().Length())
+	it := node.FieldLinks().Iterator()
+	for !it.Done() {
+		_, l := it.Next()
+		links = append(links, l.FieldHash().Link())
+	}
+	return links
+}
@@ -0,0 +1,263 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	"github.com/ipfs-shipyard/gateway-prime/mock"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+)
+
+// latencyAPI serves the blocks of a memstore after a delay, as a remote
+// backend would, and records how many blocks it loads concurrently.
+type latencyAPI struct {
+	store *memstore.Store
+	delay time.Duration
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (a *latencyAPI) NewSession(context.Context) *ipld.LinkSystem {
+	ls := lsfetcher.NewLinkSystem(a)
+	return &ls
+}
+
+func (a *latencyAPI) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return lsfetcher.New(ls)
+}
+
+func (a *latencyAPI) Resolve(_ context.Context, name string) (string, error) {
+	return name, nil
+}
+
+func (a *latencyAPI) Has(ctx context.Context, key string) (bool, error) {
+	return a.store.Has(ctx, key)
+}
+
+func (a *latencyAPI) Get(ctx context.Context, key string) ([]byte, error) {
+	a.mu.Lock()
+	a.active++
+	if a.active > a.maxActive {
+		a.maxActive = a.active
+	}
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.active--
+		a.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(a.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	data, err := a.store.Get(ctx, key)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (a *latencyAPI) resetMaxActive() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.maxActive = 0
+}
+
+// newLatencyAPI returns an API serving a UnixFS file of size bytes, split in
+// blocks of 1KiB.
+func newLatencyAPI(t testing.TB, size int, delay time.Duration) (*latencyAPI, cid.Cid, []byte) {
+	t.Helper()
+	content := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(content)
+	a := &latencyAPI{store: &memstore.Store{Bag: map[string][]byte{}}, delay: delay}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(a.store)
+	ls.SetWriteStorage(a.store)
+	lnk, _, err := builder.BuildUnixFSFile(bytes.NewReader(content), "size-1024", &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, lnk.(cidlink.Link).Cid, content
+}
+
+func readAheadServer(t testing.TB, a API, window int) *httptest.Server {
+	t.Helper()
+	h, err := makeHandler(a, &GatewayConfig{ReadAheadBlocks: window}, nil, GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func getRange(t testing.TB, url, rng string) []byte {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("unexpected status %d: %s", res.StatusCode, body)
+	}
+	return body
+}
+
+func TestReadAhead(t *testing.T) {
+	// the file has a single level of children, the gateway doesn't serve
+	// deeper files with the right length
+	a, root, content := newLatencyAPI(t, 160*1024, time.Millisecond)
+
+	for _, test := range []struct {
+		window  int
+		atLeast int
+		atMost  int
+	}{
+		{window: -1, atLeast: 1, atMost: 1},
+		{window: 0, atLeast: 2, atMost: defaultReadAheadBlocks + 1},
+		{window: 4, atLeast: 2, atMost: 4 + 1},
+	} {
+		url := readAheadServer(t, a, test.window).URL + "/ipfs/" + root.String()
+
+		a.resetMaxActive()
+		if body := getRange(t, url, ""); !bytes.Equal(body, content) {
+			t.Fatalf("window %d: unexpected content", test.window)
+		}
+		// the reader loads a block while the window is full
+		if a.maxActive < test.atLeast || a.maxActive > test.atMost {
+			t.Errorf("window %d: expected %d to %d concurrent loads, got %d", test.window, test.atLeast, test.atMost, a.maxActive)
+		}
+
+		// ranges read ahead from where they start
+		for _, rng := range [][2]int{{0, 99}, {50*1024 + 10, 100*1024 + 20}, {159 * 1024, len(content) - 1}} {
+			body := getRange(t, url, fmt.Sprintf("bytes=%d-%d", rng[0], rng[1]))
+			if !bytes.Equal(body, content[rng[0]:rng[1]+1]) {
+				t.Fatalf("window %d: unexpected content for range %v", test.window, rng)
+			}
+		}
+	}
+}
+
+func TestReadAheadLevels(t *testing.T) {
+	// more blocks than fit in a node, below two levels of intermediate nodes
+	a, root, content := newLatencyAPI(t, 400*1024, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ls := a.NewSession(ctx)
+	ls = withReadAhead(ctx, ls, 8)
+
+	node, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := unixfsnode.Reify(ipld.LinkContext{Ctx: ctx}, node, ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := file.(datamodel.LargeBytesNode).AsLargeBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.resetMaxActive()
+	body, err := ioutil.ReadAll(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatal("unexpected content")
+	}
+	if a.maxActive < 2 || a.maxActive > 8+1 {
+		t.Fatalf("expected 2 to 9 concurrent loads, got %d", a.maxActive)
+	}
+}
+
+func TestReadAheadSharedSession(t *testing.T) {
+	// the mock API returns the same LinkSystem to every session
+	a := &mock.API{}
+	ctx := context.Background()
+	shared := a.NewSession(ctx)
+	opener := reflect.ValueOf(shared.StorageReadOpener).Pointer()
+	content := bytes.Repeat([]byte("shared"), 2048)
+	lnk, _, err := builder.BuildUnixFSFile(bytes.NewReader(content), "size-1024", shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for n := 0; n < 3; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls := withReadAhead(ctx, a.NewSession(ctx), 0)
+			if ls == shared {
+				t.Error("expected read-ahead to load through a copy of the session")
+				return
+			}
+			node, err := ls.Load(ipld.LinkContext{Ctx: ctx}, lnk, dagpb.Type.PBNode)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			file, err := unixfsnode.Reify(ipld.LinkContext{Ctx: ctx}, node, ls)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, err := file.AsBytes()
+			if err != nil || !bytes.Equal(body, content) {
+				t.Errorf("unexpected content: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reflect.ValueOf(a.NewSession(ctx).StorageReadOpener).Pointer() != opener {
+		t.Fatal("expected the shared session to be left as is")
+	}
+}
+
+func BenchmarkReadAhead(b *testing.B) {
+	const size = 160 * 1024
+	a, root, _ := newLatencyAPI(b, size, time.Millisecond)
+	for _, window := range []int{-1, 8, 32} {
+		b.Run(fmt.Sprintf("window=%d", window), func(b *testing.B) {
+			url := readAheadServer(b, a, window).URL + "/ipfs/" + root.String()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				getRange(b, url, "")
+			}
+		})
+	}
+}
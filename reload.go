@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ConfigLoader returns a new GatewayConfig, typically by reading it from disk.
+type ConfigLoader func() (*GatewayConfig, error)
+
+// configSnapshot is a GatewayConfig along with the state derived from it.
+// Snapshots are immutable: reloading the configuration creates a new one,
+// and each request is served with the snapshot that was live when it
+// started.
+type configSnapshot struct {
+	config        *GatewayConfig
+	proxies       []*net.IPNet
+	knownGateways gatewayHosts
+	headers       userHeaders
+	hostHeaders   map[*GatewaySpec]userHeaders // per PublicGateways overrides
+}
+
+func newConfigSnapshot(gc *GatewayConfig) (*configSnapshot, error) {
+	if err := gc.Validate(); err != nil {
+		return nil, err
+	}
+	proxies, err := parseTrustedProxies(gc.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &configSnapshot{
+		config:        gc,
+		proxies:       proxies,
+		knownGateways: prepareKnownGateways(gc.PublicGateways),
+		headers:       newUserHeaders(gc, nil),
+		hostHeaders:   make(map[*GatewaySpec]userHeaders, len(gc.PublicGateways)),
+	}
+	for _, spec := range gc.PublicGateways {
+		if spec != nil {
+			s.hostHeaders[spec] = newUserHeaders(gc, spec)
+		}
+	}
+	return s, nil
+}
+
+// userHeadersFor returns the custom headers for requests matching the given
+// public gateway, or the global ones if spec is nil or unknown.
+func (s *configSnapshot) userHeadersFor(spec *GatewaySpec) userHeaders {
+	if h, ok := s.hostHeaders[spec]; ok {
+		return h
+	}
+	return s.headers
+}
+
+type configSnapshotKeyType struct{}
+
+var configSnapshotKey configSnapshotKeyType
+
+// configSnapshotFor returns the configuration the request is served with.
+// Outside of a handler built by makeHandler, fallback is returned.
+func configSnapshotFor(r *http.Request, fallback *configSnapshot) *configSnapshot {
+	if s, ok := r.Context().Value(configSnapshotKey).(*configSnapshot); ok {
+		return s
+	}
+	return fallback
+}
+
+// liveConfig holds the current configuration of a gateway, which can be
+// swapped at runtime.
+type liveConfig struct {
+	mu      sync.Mutex // serializes reloads
+	current atomic.Value
+}
+
+func newLiveConfig(gc *GatewayConfig) (*liveConfig, error) {
+	snap, err := newConfigSnapshot(gc)
+	if err != nil {
+		return nil, err
+	}
+	l := &liveConfig{}
+	l.current.Store(snap)
+	return l, nil
+}
+
+func (l *liveConfig) load() *configSnapshot {
+	return l.current.Load().(*configSnapshot)
+}
+
+// store validates gc and makes it the live configuration. The previous
+// configuration is kept if gc is invalid.
+func (l *liveConfig) store(gc *GatewayConfig) error {
+	snap, err := newConfigSnapshot(gc)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.load().config
+	for _, field := range restartOnlyChanges(old, gc) {
+		log.Warnf("configuration reloaded, but changes to %s only apply after a restart", field)
+	}
+	l.current.Store(snap)
+	return nil
+}
+
+func (l *liveConfig) reload(load ConfigLoader) error {
+	gc, err := load()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	return l.store(gc)
+}
+
+// restartOnlyChanges lists the fields which differ between the two
+// configurations but are only read when the server starts.
+func restartOnlyChanges(old, gc *GatewayConfig) []string {
+	var fields []string
+	if old.ReadTimeout != gc.ReadTimeout {
+		fields = append(fields, "ReadTimeout")
+	}
+	if old.ReadHeaderTimeout != gc.ReadHeaderTimeout {
+		fields = append(fields, "ReadHeaderTimeout")
+	}
+	if old.WriteTimeout != gc.WriteTimeout {
+		fields = append(fields, "WriteTimeout")
+	}
+	if old.IdleTimeout != gc.IdleTimeout {
+		fields = append(fields, "IdleTimeout")
+	}
+	if old.H2C != gc.H2C {
+		fields = append(fields, "H2C")
+	}
+	if old.ResolveCacheSize != gc.ResolveCacheSize {
+		fields = append(fields, "ResolveCacheSize")
+	}
+	return fields
+}
+
+// Reload validates gc and atomically makes it the configuration of the
+// server. Requests in flight finish with the previous configuration. If gc is
+// invalid, an error is returned and the current configuration is kept.
+//
+// Everything but the settings of the listeners themselves can be reloaded:
+// ReadTimeout, ReadHeaderTimeout, WriteTimeout, IdleTimeout, H2C,
+// ResolveCacheSize and the set of TLS certificate files only take effect after
+// a restart. Options keep
+// using the configuration they were built with for their own settings, eg.
+// RateLimitOption and TrustedProxies.
+func (s *Server) Reload(gc *GatewayConfig) error {
+	return s.config.store(gc)
+}
+
+// WatchConfig reloads the configuration with load whenever one of the files
+// changes, checking every interval. Configurations failing to load or
+// validate are logged and ignored. It blocks until ctx is done.
+func (s *Server) WatchConfig(ctx context.Context, interval time.Duration, load ConfigLoader, paths ...string) {
+	watchFiles(ctx, interval, func() {
+		s.reloadWith(load, "configuration files changed")
+	}, paths...)
+}
+
+// ReloadOnSignal reloads the configuration with load whenever the process
+// receives one of the given signals, or SIGHUP if none is given. It blocks
+// until ctx is done.
+func (s *Server) ReloadOnSignal(ctx context.Context, load ConfigLoader, sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	defer signal.Stop(ch)
+	s.reloadOn(ctx, ch, load)
+}
+
+func (s *Server) reloadOn(ctx context.Context, ch <-chan os.Signal, load ConfigLoader) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-ch:
+			s.reloadWith(load, "received "+sig.String())
+		}
+	}
+}
+
+func (s *Server) reloadWith(load ConfigLoader, reason string) {
+	if err := s.config.reload(load); err != nil {
+		log.Errorf("%s, but not reloading configuration: %s", reason, err)
+		return
+	}
+	log.Infof("%s, configuration reloaded", reason)
+}
+
+// ReloadHandler returns an admin endpoint which reloads the configuration of
+// the server with load when it receives a POST request. It is not
+// authenticated: mount it on the mux of a private listener, eg. one bound to
+// localhost or a unix socket, rather than as an option of s.
+func (s *Server) ReloadHandler(load ConfigLoader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.config.reload(load); err != nil {
+			log.Errorf("configuration reload requested, but failed: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("configuration reloaded through %s", r.URL.Path)
+		fmt.Fprintln(w, "configuration reloaded")
+	})
+}
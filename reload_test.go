@@ -0,0 +1,210 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/gateway-prime/mock"
+)
+
+// headerOption serves the value of the X-Test header of the live
+// configuration on /header, once the gate, if any, is opened.
+func headerOption(gate chan struct{}) ServeOption {
+	return func(_ API, _ *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		mux.HandleFunc("/header", func(w http.ResponseWriter, r *http.Request) {
+			if gate != nil {
+				<-gate
+			}
+			w.Write([]byte(strings.Join(configSnapshotFor(r, nil).config.HTTPHeaders["X-Test"], ",")))
+		})
+		return mux, nil
+	}
+}
+
+func testConfig(value string) *GatewayConfig {
+	return &GatewayConfig{HTTPHeaders: map[string][]string{"X-Test": {value}}}
+}
+
+func getBody(t *testing.T, url string) string {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestServerReload(t *testing.T) {
+	gate := make(chan struct{})
+	s, err := Serve(&mock.API{}, testConfig("a"), listenLocal(t), headerOption(nil),
+		func(_ API, _ *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+			// gated version, to check in-flight requests
+			child := http.NewServeMux()
+			mux.Handle("/slow/", http.StripPrefix("/slow", child))
+			return headerOption(gate)(nil, nil, nil, child)
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	url := "http://" + s.Addrs()[0].String()
+
+	if body := getBody(t, url+"/header"); body != "a" {
+		t.Fatalf("expected initial configuration, got %q", body)
+	}
+
+	inFlight := make(chan string, 1)
+	go func() { inFlight <- getBody(t, url+"/slow/header") }()
+	// wait for the request to get its snapshot
+	time.Sleep(50 * time.Millisecond)
+
+	if err := s.Reload(testConfig("b")); err != nil {
+		t.Fatal(err)
+	}
+	if body := getBody(t, url+"/header"); body != "b" {
+		t.Fatalf("expected reloaded configuration, got %q", body)
+	}
+	close(gate)
+	if body := <-inFlight; body != "a" {
+		t.Fatalf("expected in-flight request to keep the previous configuration, got %q", body)
+	}
+
+	// invalid configurations are not applied
+	bad := testConfig("c")
+	bad.TrustedProxies = []string{"not-an-ip"}
+	if err := s.Reload(bad); err == nil {
+		t.Fatal("expected an invalid configuration to be rejected")
+	}
+	if err := s.Reload(nil); err == nil {
+		t.Fatal("expected a nil configuration to be rejected")
+	}
+	if body := getBody(t, url+"/header"); body != "b" {
+		t.Fatalf("expected previous configuration to be kept, got %q", body)
+	}
+}
+
+func TestServerReloadTriggers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "header")
+	if err := ioutil.WriteFile(file, []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	load := func() (*GatewayConfig, error) {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			return nil, errors.New("empty configuration")
+		}
+		return testConfig(string(b)), nil
+	}
+	gc, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Serve(&mock.API{}, gc, listenLocal(t), headerOption(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	url := "http://" + s.Addrs()[0].String()
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/admin/reload", s.ReloadHandler(load))
+	admin := httptest.NewServer(adminMux)
+	defer admin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// file watch
+	go s.WatchConfig(ctx, 10*time.Millisecond, load, file)
+	// let the watcher record the current state of the file
+	time.Sleep(50 * time.Millisecond)
+	if err := ioutil.WriteFile(file, []byte("watched"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for getBody(t, url+"/header") != "watched" {
+		if time.Now().After(deadline) {
+			t.Fatal("configuration was not reloaded after the file changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// signal
+	sigs := make(chan os.Signal)
+	go s.reloadOn(ctx, sigs, load)
+	if err := ioutil.WriteFile(file, []byte("signaled"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sigs <- syscall.SIGHUP
+	sigs <- syscall.SIGHUP // processed once the first one is
+	if body := getBody(t, url+"/header"); body != "signaled" {
+		t.Fatalf("expected configuration to be reloaded on signal, got %q", body)
+	}
+
+	// admin endpoint, on its own listener
+	if err := ioutil.WriteFile(file, []byte("admin"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(url+"/admin/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the public listener not to reload, got %d", res.StatusCode)
+	}
+	res, err = http.Get(admin.URL + "/admin/reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET to be refused, got %d", res.StatusCode)
+	}
+	res, err = http.Post(admin.URL+"/admin/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("reload failed with %d", res.StatusCode)
+	}
+	if body := getBody(t, url+"/header"); body != "admin" {
+		t.Fatalf("expected configuration to be reloaded through the admin endpoint, got %q", body)
+	}
+
+	cancel() // stop the watcher before breaking the file
+	if err := ioutil.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.Post(admin.URL+"/admin/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected a failed reload to be reported, got %d", res.StatusCode)
+	}
+	if body := getBody(t, url+"/header"); body != "admin" {
+		t.Fatalf("expected previous configuration to be kept, got %q", body)
+	}
+}
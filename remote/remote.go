@@ -0,0 +1,533 @@
+// Package remote implements a gateway API backed by upstream trustless
+// gateways: blocks are fetched over HTTP with ?format=raw, or ?format=car for
+// whole DAGs, and verified against their CID before being used.
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	"github.com/ipfs-shipyard/gateway-prime/coalesce"
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	logging "github.com/ipfs/go-log"
+	gocar "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+var log = logging.Logger("gateway/remote")
+
+// maxBlockSize bounds the size of raw blocks read from upstreams. Blocks are
+// at most 2MiB on the IPFS network.
+const maxBlockSize = 4 << 20
+
+const (
+	// DefaultMaxCARBytes is the number of bytes of blocks read from a CAR
+	// when API.MaxCARBytes is zero.
+	DefaultMaxCARBytes = 64 << 20
+	// DefaultMaxSessionBytes is the number of bytes of blocks a session keeps
+	// when API.MaxSessionBytes is zero.
+	DefaultMaxSessionBytes = 256 << 20
+)
+
+var (
+	// ErrHashMismatch is returned when an upstream sends data which doesn't
+	// match the requested CID.
+	ErrHashMismatch = errors.New("block does not match its CID")
+
+	errCARTooLarge = errors.New("CAR is larger than the fetch limit")
+	errSessionFull = errors.New("session is full")
+)
+
+// API fetches blocks from upstream gateways. Each session keeps the blocks
+// it fetched, up to MaxSessionBytes, so they are downloaded at most once per
+// request, and concurrent sessions fetching the same block or DAG share a
+// single download.
+type API struct {
+	// Client is used for upstream requests, http.DefaultClient if nil.
+	Client *http.Client
+
+	// Resolver resolves names for the gateway. When nil, names are returned
+	// unchanged, meaning resolution is not supported, unless ResolveNames
+	// is set.
+	Resolver func(ctx context.Context, name string) (string, error)
+
+	// ResolveNames makes the upstreams resolve the /ipns names, when there
+	// is no Resolver. Unlike blocks, their answers can't be verified and are
+	// trusted. Resolutions stay valid for the max-age of their responses.
+	ResolveNames bool
+
+	// MaxCARBytes bounds the bytes of blocks read from a CAR: past it, the
+	// remaining blocks are fetched one at a time, when they are needed.
+	// DefaultMaxCARBytes if zero.
+	MaxCARBytes int64
+
+	// MaxSessionBytes bounds the bytes of blocks a session keeps. Past it,
+	// CARs are not read any further, and blocks are fetched each time they
+	// are needed. DefaultMaxSessionBytes if zero.
+	MaxSessionBytes int64
+
+	upstreams []string
+	fetches   coalesce.Group
+
+	mu sync.Mutex
+	// sessions waiting for a CAR, by root
+	carSinks map[string]map[*carSink]struct{}
+}
+
+var (
+	_ gateway.API         = (*API)(nil)
+	_ gateway.TTLResolver = (*API)(nil)
+)
+
+// New returns an API fetching blocks from the given gateway URLs, eg.
+// https://ipfs.io, which are tried in order.
+func New(upstreams ...string) (*API, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream gateway provided")
+	}
+	a := &API{}
+	for _, u := range upstreams {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("invalid upstream gateway %q: must be an http or https URL", u)
+		}
+		a.upstreams = append(a.upstreams, strings.TrimSuffix(u, "/"))
+	}
+	return a, nil
+}
+
+// NewSession returns a LinkSystem which loads blocks from the session, and
+// fetches the missing ones from the upstreams. The session ends with ctx.
+func (a *API) NewSession(ctx context.Context) *ipld.LinkSystem {
+	s := &session{api: a, ctx: ctx, blocks: make(map[string][]byte)}
+	ls := lsfetcher.NewLinkSystem(s)
+	ls.SetWriteStorage(s)
+	// blocks are verified before they are stored in the session
+	ls.TrustedStorage = true
+	return &ls
+}
+
+// FetcherForSession returns a fetcher which fetches the missing blocks of the
+// traversed DAGs. Traversals of whole DAGs are fetched as a single CAR, whose
+// blocks are added to the session through the write storage of ls.
+func (a *API) FetcherForSession(ls *ipld.LinkSystem) fetcher.Fetcher {
+	return &carFetcher{Fetcher: lsfetcher.New(ls), api: a, ls: ls}
+}
+
+// Resolve resolves name with the Resolver, or the upstreams.
+func (a *API) Resolve(ctx context.Context, name string) (string, error) {
+	resolved, _, err := a.ResolveTTL(ctx, name)
+	return resolved, err
+}
+
+// ResolveTTL is Resolve, which also returns the time the resolution stays
+// valid for: the max-age of the upstream response, or gateway.DefaultNameTTL.
+func (a *API) ResolveTTL(ctx context.Context, name string) (string, time.Duration, error) {
+	if a.Resolver != nil {
+		resolved, err := a.Resolver(ctx, name)
+		return resolved, gateway.DefaultNameTTL, err
+	}
+	if !a.ResolveNames || !strings.HasPrefix(name, "/ipns/") {
+		return name, 0, nil
+	}
+	var resolved string
+	var ttl time.Duration
+	err := a.tryUpstreams(ctx, name, func(u string) error {
+		var err error
+		resolved, ttl, err = a.resolveFrom(ctx, u, name)
+		return err
+	})
+	return resolved, ttl, err
+}
+
+// resolveFrom resolves name with an upstream, from the X-Ipfs-Roots header of
+// its response, whose first CID is the one the name points to.
+func (a *API) resolveFrom(ctx context.Context, upstream, name string) (string, time.Duration, error) {
+	target := upstream + "/ipns/" + url.PathEscape(strings.TrimPrefix(name, "/ipns/")) + "?format=raw"
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+	res, err := a.client().Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return "", 0, gateway.ErrNotFound
+	default:
+		return "", 0, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	root := strings.TrimSpace(strings.Split(res.Header.Get("X-Ipfs-Roots"), ",")[0])
+	c, err := cid.Decode(root)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid X-Ipfs-Roots %q: %w", res.Header.Get("X-Ipfs-Roots"), err)
+	}
+	return "/ipfs/" + c.String(), maxAge(res.Header.Get("Cache-Control")), nil
+}
+
+// maxAge returns the max-age directive of a Cache-Control header, or
+// gateway.DefaultNameTTL without one.
+func maxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(strings.ToLower(directive), "max-age=") {
+			continue
+		}
+		if secs, err := strconv.Atoi(directive[len("max-age="):]); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return gateway.DefaultNameTTL
+}
+
+func (a *API) client() *http.Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return http.DefaultClient
+}
+
+// fetch tries each upstream in turn until one returns a response for the
+// content path, which fn processes. Upstreams failing or sending invalid data
+// are skipped. If all of them answer 404, a gateway.ErrNotFound is returned.
+func (a *API) fetch(ctx context.Context, c cid.Cid, format, accept string, fn func(io.Reader) error) error {
+	return a.tryUpstreams(ctx, c.String(), func(u string) error {
+		return a.fetchFrom(ctx, u, c, format, accept, fn)
+	})
+}
+
+// tryUpstreams calls fn with each upstream in turn until it succeeds. If all
+// of them fail with gateway.ErrNotFound, a gateway.ErrNotFound is returned.
+func (a *API) tryUpstreams(ctx context.Context, what string, fn func(upstream string) error) error {
+	var errs []string
+	notFound := 0
+	for _, u := range a.upstreams {
+		err := fn(u)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errCARTooLarge) {
+			// the other upstreams send the same CAR
+			return err
+		}
+		if errors.Is(err, gateway.ErrNotFound) {
+			notFound++
+		}
+		log.Debugf("failed to fetch %s from %s: %s", what, u, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", u, err))
+	}
+	if notFound == len(a.upstreams) {
+		return fmt.Errorf("%w: %s", gateway.ErrNotFound, what)
+	}
+	return fmt.Errorf("failed to fetch %s: %s", what, strings.Join(errs, "; "))
+}
+
+func (a *API) fetchFrom(ctx context.Context, upstream string, c cid.Cid, format, accept string, fn func(io.Reader) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream+"/ipfs/"+c.String()+"?format="+format, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", accept)
+	res, err := a.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return fn(res.Body)
+	case http.StatusNotFound, http.StatusGone:
+		return gateway.ErrNotFound
+	default:
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+}
+
+// session holds the blocks fetched for a request, and implements the read
+// and write storages of its LinkSystem.
+type session struct {
+	api *API
+	ctx context.Context
+
+	mu     sync.RWMutex
+	blocks map[string][]byte
+	size   int64
+}
+
+func (s *session) Has(_ context.Context, key string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blocks[key]
+	return ok, nil
+}
+
+// Get returns the block from the session, fetching it if needed.
+func (s *session) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.RLock()
+	data, ok := s.blocks[key]
+	s.mu.RUnlock()
+	if ok {
+		return data, nil
+	}
+
+	c, err := cid.Cast([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if ctx == nil {
+		ctx = s.ctx
+	}
+	v, _, err := s.api.fetches.Do(ctx, "raw/"+key, func(ctx context.Context) (interface{}, error) {
+		var data []byte
+		err := s.api.fetch(ctx, c, "raw", "application/vnd.ipld.raw", func(r io.Reader) error {
+			b, err := ioutil.ReadAll(io.LimitReader(r, maxBlockSize+1))
+			if err != nil {
+				return err
+			}
+			if len(b) > maxBlockSize {
+				return fmt.Errorf("block %s is larger than %d bytes", c, maxBlockSize)
+			}
+			if err := verify(c, b); err != nil {
+				return err
+			}
+			data = b
+			return nil
+		})
+		return data, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	data = v.([]byte)
+	// a full session fetches the block again next time
+	_ = s.put(key, data)
+	return data, nil
+}
+
+// Put adds a block to the session. It is only called by the LinkSystem for
+// blocks it hashed itself, and by carFetcher for verified blocks.
+func (s *session) Put(_ context.Context, key string, content []byte) error {
+	return s.put(key, content)
+}
+
+// put keeps a block, unless the session holds MaxSessionBytes already.
+func (s *session) put(key string, content []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blocks[key]; ok {
+		return nil
+	}
+	if s.size+int64(len(content)) > s.api.maxSessionBytes() {
+		return errSessionFull
+	}
+	s.blocks[key] = content
+	s.size += int64(len(content))
+	return nil
+}
+
+func (a *API) maxSessionBytes() int64 {
+	if a.MaxSessionBytes != 0 {
+		return a.MaxSessionBytes
+	}
+	return DefaultMaxSessionBytes
+}
+
+func (a *API) maxCARBytes() int64 {
+	if a.MaxCARBytes != 0 {
+		return a.MaxCARBytes
+	}
+	return DefaultMaxCARBytes
+}
+
+// carSink writes the blocks of a CAR to the write storage of a session, as
+// they are read.
+type carSink struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	ls     *ipld.LinkSystem
+
+	mu  sync.Mutex
+	err error
+}
+
+// write stores blk in the session, and stops waiting for the CAR once it
+// fails, eg. when the session is full.
+func (sk *carSink) write(blk blocks.Block) {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	if sk.err != nil {
+		return
+	}
+	if err := put(sk.ctx, sk.ls, blk); err != nil {
+		sk.err = err
+		sk.cancel()
+	}
+}
+
+func (sk *carSink) failure() error {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	return sk.err
+}
+
+// fetchCAR fetches the whole DAG under root as a CAR, writing its blocks to
+// the write storage of ls as they are read. Sessions asking for a CAR being
+// fetched join the download, and get the blocks read from then on. Reading
+// stops after MaxCARBytes.
+func (a *API) fetchCAR(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid) error {
+	key := root.KeyString()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sk := &carSink{ctx: ctx, cancel: cancel, ls: ls}
+	a.addSink(key, sk)
+	defer a.removeSink(key, sk)
+
+	_, _, err := a.fetches.Do(ctx, "car/"+key, func(ctx context.Context) (interface{}, error) {
+		var read int64
+		return nil, a.fetch(ctx, root, "car", "application/vnd.ipld.car", func(r io.Reader) error {
+			br, err := gocar.NewBlockReader(r)
+			if err != nil {
+				return err
+			}
+			for {
+				// the block reader checks each block against its CID
+				blk, err := br.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				// blocks read before a failure are verified, and
+				// still useful
+				read += int64(len(blk.RawData()))
+				if read > a.maxCARBytes() {
+					return errCARTooLarge
+				}
+				a.writeSinks(key, blk)
+			}
+		})
+	})
+	if serr := sk.failure(); serr != nil {
+		return serr
+	}
+	return err
+}
+
+func (a *API) addSink(key string, sk *carSink) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.carSinks == nil {
+		a.carSinks = make(map[string]map[*carSink]struct{})
+	}
+	if a.carSinks[key] == nil {
+		a.carSinks[key] = make(map[*carSink]struct{})
+	}
+	a.carSinks[key][sk] = struct{}{}
+}
+
+func (a *API) removeSink(key string, sk *carSink) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.carSinks[key], sk)
+	if len(a.carSinks[key]) == 0 {
+		delete(a.carSinks, key)
+	}
+}
+
+// writeSinks writes blk to the sessions waiting for the CAR of key.
+func (a *API) writeSinks(key string, blk blocks.Block) {
+	a.mu.Lock()
+	sinks := make([]*carSink, 0, len(a.carSinks[key]))
+	for sk := range a.carSinks[key] {
+		sinks = append(sinks, sk)
+	}
+	a.mu.Unlock()
+	for _, sk := range sinks {
+		sk.write(blk)
+	}
+}
+
+// put writes a verified block to the write storage of ls.
+func put(ctx context.Context, ls *ipld.LinkSystem, blk blocks.Block) error {
+	w, commit, err := ls.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(blk.RawData()); err != nil {
+		return err
+	}
+	return commit(cidlink.Link{Cid: blk.Cid()})
+}
+
+// verify checks that data hashes to c.
+func verify(c cid.Cid, data []byte) error {
+	hashed, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !hashed.Equals(c) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrHashMismatch, c, hashed)
+	}
+	return nil
+}
+
+// carFetcher prefetches whole DAGs as a single CAR before traversing them.
+type carFetcher struct {
+	*lsfetcher.Fetcher
+	api *API
+	ls  *ipld.LinkSystem
+}
+
+func (f *carFetcher) NodeMatching(ctx context.Context, root ipld.Node, match ipld.Node, cb fetcher.FetchCallback) error {
+	if root.Kind() == datamodel.Kind_Link {
+		if lnk, err := root.AsLink(); err == nil {
+			f.prefetch(ctx, lnk, match)
+		}
+	}
+	return f.Fetcher.NodeMatching(ctx, root, match, cb)
+}
+
+func (f *carFetcher) BlockMatchingOfType(ctx context.Context, root ipld.Link, match ipld.Node, proto ipld.NodePrototype, cb fetcher.FetchCallback) error {
+	f.prefetch(ctx, root, match)
+	return f.Fetcher.BlockMatchingOfType(ctx, root, match, proto, cb)
+}
+
+// prefetch fetches the DAG under root as a CAR if the selector matches all of
+// it. Failures are ignored: missing blocks are then fetched one at a time.
+func (f *carFetcher) prefetch(ctx context.Context, root ipld.Link, match ipld.Node) {
+	if f.ls.StorageWriteOpener == nil || !datamodel.DeepEqual(match, selectorparse.CommonSelector_ExploreAllRecursively) {
+		return
+	}
+	lnk, ok := root.(cidlink.Link)
+	if !ok {
+		return
+	}
+	if err := f.api.fetchCAR(ctx, f.ls, lnk.Cid); err != nil {
+		log.Debugf("failed to fetch %s as a CAR, falling back to blocks: %s", lnk.Cid, err)
+	}
+}
@@ -0,0 +1,401 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gateway "github.com/ipfs-shipyard/gateway-prime"
+	"github.com/ipfs-shipyard/gateway-prime/coalesce"
+	"github.com/ipfs-shipyard/gateway-prime/lsfetcher"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-fetcher"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	gocar "github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// testDAG is a UnixFS directory holding a multi-block file.
+type testDAG struct {
+	ls      ipld.LinkSystem
+	root    cid.Cid
+	content string
+}
+
+func newTestDAG(t *testing.T) *testDAG {
+	t.Helper()
+	store := &memstore.Store{Bag: map[string][]byte{}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+
+	content := strings.Repeat("hello world ", 100)
+	file, size, err := builder.BuildUnixFSFile(strings.NewReader(content), "size-256", &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := builder.BuildUnixFSDirectoryEntry("hello.txt", int64(size), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := builder.BuildUnixFSDirectory([]dagpb.PBLink{entry}, &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDAG{ls: ls, root: root.(cidlink.Link).Cid, content: content}
+}
+
+// upstream serves the DAG like a trustless gateway, corrupting raw blocks if
+// asked to, and counts requests per format.
+type upstream struct {
+	*httptest.Server
+	raw, car int32
+	// hold delays responses until closed, when set
+	hold chan struct{}
+	// names maps the /ipns names served to their root, answered with the
+	// given Cache-Control
+	names        map[string]cid.Cid
+	cacheControl string
+}
+
+func newUpstream(t *testing.T, dag *testDAG, corrupt bool) *upstream {
+	u := &upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ipns/") {
+			root, ok := u.names[strings.TrimPrefix(r.URL.Path, "/ipns/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("X-Ipfs-Roots", root.String())
+			if u.cacheControl != "" {
+				w.Header().Set("Cache-Control", u.cacheControl)
+			}
+			return
+		}
+		c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if u.hold != nil {
+			<-u.hold
+		}
+		switch r.URL.Query().Get("format") {
+		case "raw":
+			atomic.AddInt32(&u.raw, 1)
+			_, data, err := dag.ls.LoadPlusRaw(ipld.LinkContext{}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			if corrupt {
+				data = append([]byte("corrupted"), data...)
+			}
+			w.Write(data)
+		case "car":
+			atomic.AddInt32(&u.car, 1)
+			if _, err := dag.ls.StorageReadOpener(ipld.LinkContext{}, cidlink.Link{Cid: c}); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			if corrupt {
+				http.Error(w, "no CAR here", http.StatusNotImplemented)
+				return
+			}
+			gocar.TraverseV1(r.Context(), &dag.ls, c, selectorparse.CommonSelector_ExploreAllRecursively, w)
+		default:
+			http.Error(w, "unsupported format", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func serve(t *testing.T, api gateway.API) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gateway.Serve(api, &gateway.GatewayConfig{}, l, gateway.GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return "http://" + s.Addrs()[0].String()
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, body
+}
+
+func TestRemoteAPI(t *testing.T) {
+	dag := newTestDAG(t)
+	corrupted := newUpstream(t, dag, true)
+	good := newUpstream(t, dag, false)
+
+	api, err := New(corrupted.URL, good.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := serve(t, api)
+
+	code, body := get(t, url+"/ipfs/"+dag.root.String()+"/hello.txt")
+	if code != http.StatusOK || string(body) != dag.content {
+		t.Fatalf("unexpected response %d %q", code, body)
+	}
+	if atomic.LoadInt32(&corrupted.raw) == 0 {
+		t.Fatal("expected the first upstream to be tried")
+	}
+
+	// whole DAGs are fetched as a CAR
+	atomic.StoreInt32(&good.raw, 0)
+	code, body = get(t, url+"/ipfs/"+dag.root.String()+"?format=car")
+	if code != http.StatusOK {
+		t.Fatalf("unexpected CAR response %d %q", code, body)
+	}
+	// only the root block may be fetched on its own, when resolving the path
+	if atomic.LoadInt32(&good.car) != 1 || atomic.LoadInt32(&good.raw) > 1 {
+		t.Fatalf("expected the DAG to be fetched as a CAR, got %d CAR and %d raw requests", good.car, good.raw)
+	}
+	br, err := gocar.NewBlockReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Roots[0] != dag.root {
+		t.Fatalf("unexpected CAR root %s", br.Roots[0])
+	}
+
+	missing := "bafkreie7q3iidccmpvszul7kudcvvuavuo7u6gzlbobczuk5nqk3b4akba"
+	if code, _ := get(t, url+"/ipfs/"+missing+"?format=raw"); code != http.StatusNotFound {
+		t.Fatalf("expected blocks missing upstream to be 404, got %d", code)
+	}
+}
+
+func TestRemoteAPICorrupted(t *testing.T) {
+	dag := newTestDAG(t)
+	up := newUpstream(t, dag, true)
+	api, err := New(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := api.NewSession(context.Background())
+	_, err = api.FetcherForSession(ls).BlockOfType(context.Background(), cidlink.Link{Cid: dag.root}, basicnode.Prototype.Any)
+	if err == nil || !strings.Contains(err.Error(), ErrHashMismatch.Error()) {
+		t.Fatalf("expected a hash mismatch, got %v", err)
+	}
+	// the corrupted block was not kept by the session, and is fetched again
+	fetched := atomic.LoadInt32(&up.raw)
+	if _, err := api.FetcherForSession(ls).BlockOfType(context.Background(), cidlink.Link{Cid: dag.root}, basicnode.Prototype.Any); err == nil {
+		t.Fatal("expected the corrupted block to be rejected")
+	}
+	if atomic.LoadInt32(&up.raw) == fetched {
+		t.Fatal("expected the corrupted block not to be stored in the session")
+	}
+
+	url := serve(t, api)
+	if code, body := get(t, url+"/ipfs/"+dag.root.String()+"/hello.txt"); code == http.StatusOK {
+		t.Fatalf("expected corrupted content not to be served, got %q", body)
+	}
+}
+
+func TestRemoteAPISessions(t *testing.T) {
+	dag := newTestDAG(t)
+	api, err := New(newUpstream(t, dag, false).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sessions whose context is never done don't leak
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		api.FetcherForSession(api.NewSession(context.Background()))
+	}
+	if after := runtime.NumGoroutine(); after > before+10 {
+		t.Fatalf("expected sessions not to start goroutines, got %d more", after-before)
+	}
+
+	// the CAR of a traversal is stored in the session
+	up := newUpstream(t, dag, false)
+	api, err = New(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := api.NewSession(context.Background())
+	all := selectorparse.CommonSelector_ExploreAllRecursively
+	noop := func(fetcher.FetchResult) error { return nil }
+	if err := api.FetcherForSession(ls).BlockMatchingOfType(context.Background(), cidlink.Link{Cid: dag.root}, all, nil, noop); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsfetcher.New(ls).BlockMatchingOfType(context.Background(), cidlink.Link{Cid: dag.root}, all, nil, noop); err != nil {
+		t.Fatal(err)
+	}
+	if car, raw := atomic.LoadInt32(&up.car), atomic.LoadInt32(&up.raw); car != 1 || raw != 0 {
+		t.Fatalf("expected the session to keep the blocks of the CAR, got %d CAR and %d raw requests", car, raw)
+	}
+}
+
+func TestRemoteAPILimits(t *testing.T) {
+	dag := newTestDAG(t)
+	all := selectorparse.CommonSelector_ExploreAllRecursively
+	for _, test := range []struct {
+		name      string
+		car, sess int64
+	}{
+		{name: "CAR", car: 300},
+		{name: "session", sess: 300},
+	} {
+		up := newUpstream(t, dag, false)
+		api, err := New(up.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api.MaxCARBytes, api.MaxSessionBytes = test.car, test.sess
+
+		// the rest of the DAG is fetched one block at a time
+		ls := api.NewSession(context.Background())
+		noop := func(fetcher.FetchResult) error { return nil }
+		if err := api.FetcherForSession(ls).BlockMatchingOfType(context.Background(), cidlink.Link{Cid: dag.root}, all, nil, noop); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if car, raw := atomic.LoadInt32(&up.car), atomic.LoadInt32(&up.raw); car != 1 || raw == 0 {
+			t.Fatalf("%s: expected the CAR to be cut short, got %d CAR and %d raw requests", test.name, car, raw)
+		}
+	}
+
+	// full sessions fetch the blocks they no longer keep again
+	up := newUpstream(t, dag, false)
+	api, err := New(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.MaxSessionBytes = 1
+	ls := api.NewSession(context.Background())
+	for i := 0; i < 2; i++ {
+		if _, err := api.FetcherForSession(ls).BlockOfType(context.Background(), cidlink.Link{Cid: dag.root}, basicnode.Prototype.Any); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if raw := atomic.LoadInt32(&up.raw); raw != 2 {
+		t.Fatalf("expected the block not to be kept by a full session, got %d raw requests", raw)
+	}
+}
+
+func TestRemoteAPICoalesced(t *testing.T) {
+	dag := newTestDAG(t)
+	up := newUpstream(t, dag, false)
+	up.hold = make(chan struct{})
+	api, err := New(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls := api.NewSession(context.Background())
+			f := api.FetcherForSession(ls)
+			err := f.BlockMatchingOfType(context.Background(), cidlink.Link{Cid: dag.root}, selectorparse.CommonSelector_ExploreAllRecursively, nil, func(fetcher.FetchResult) error { return nil })
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// let the sessions start fetching
+	time.Sleep(100 * time.Millisecond)
+	close(up.hold)
+	wg.Wait()
+
+	if car, raw := atomic.LoadInt32(&up.car), atomic.LoadInt32(&up.raw); car != 1 || raw != 0 {
+		t.Fatalf("expected the sessions to share a single CAR fetch, got %d CAR and %d raw requests", car, raw)
+	}
+}
+
+func TestRemoteAPIResolve(t *testing.T) {
+	dag := newTestDAG(t)
+	up := newUpstream(t, dag, false)
+	up.names = map[string]cid.Cid{"example.com": dag.root}
+	up.cacheControl = "public, max-age=30"
+
+	api, err := New(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := api.Resolve(context.Background(), "/ipns/example.com"); p != "/ipns/example.com" {
+		t.Fatalf("expected names to be returned unchanged without ResolveNames, got %q", p)
+	}
+
+	api.ResolveNames = true
+	// the TTL reaches the gateway through the decorators
+	var wrapped gateway.API = coalesce.New(api)
+	p, ttl, err := gateway.ResolveNameTTL(context.Background(), wrapped, "/ipns/example.com")
+	if err != nil || p != "/ipfs/"+dag.root.String() || ttl != 30*time.Second {
+		t.Fatalf("unexpected resolution %q for %s (%v)", p, ttl, err)
+	}
+	if _, err := api.Resolve(context.Background(), "/ipns/missing.example.com"); !errors.Is(err, gateway.ErrNotFound) {
+		t.Fatalf("expected names unknown upstream to fail with ErrNotFound, got %v", err)
+	}
+
+	up.cacheControl = ""
+	if _, ttl, _ := api.ResolveTTL(context.Background(), "/ipns/example.com"); ttl != gateway.DefaultNameTTL {
+		t.Fatalf("expected the default TTL without max-age, got %s", ttl)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gateway.Serve(api, &gateway.GatewayConfig{}, l, gateway.GatewayOption("/ipfs", "/ipns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	code, body := get(t, "http://"+s.Addrs()[0].String()+"/ipns/example.com/hello.txt")
+	if code != http.StatusOK || string(body) != dag.content {
+		t.Fatalf("unexpected response %d %q", code, body)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(); err == nil {
+		t.Fatal("expected an error without upstreams")
+	}
+	if _, err := New("ipfs.io"); err == nil {
+		t.Fatal("expected an error for upstreams which aren't URLs")
+	}
+
+	api, _ := New("https://ipfs.io")
+	api.Resolver = func(context.Context, string) (string, error) { return "", errors.New("nope") }
+	if _, err := api.Resolve(context.Background(), "/ipns/example.com"); err == nil {
+		t.Fatal("expected the resolver to be used")
+	}
+}
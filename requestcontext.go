@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// The context of the requests served by the gateway handler carries what
+// API implementations need to route them, and lets them add debug headers to
+// the response.
+
+type contentPathKeyType struct{}
+
+var contentPathKey contentPathKeyType
+
+type responseHeadersKeyType struct{}
+
+var responseHeadersKey responseHeadersKeyType
+
+// ContentPathFromContext returns the content path requested from the gateway,
+// before resolution, for API implementations serving a request with ctx.
+func ContentPathFromContext(ctx context.Context) (Path, bool) {
+	p, ok := ctx.Value(contentPathKey).(Path)
+	return p, ok
+}
+
+// RequestHostFromContext returns the host the client used to reach the
+// gateway, for API implementations serving a request with ctx.
+func RequestHostFromContext(ctx context.Context) (string, bool) {
+	o, ok := ctx.Value(requestOriginKey).(origin)
+	return o.host, ok
+}
+
+// AddResponseHeader adds a header to the response to the request served with
+// ctx, unless it already has this value. API implementations use it to report
+// how requests were served, eg. with X-Ipfs-Backend. Headers added once the
+// response headers are written, or outside of the gateway handler, are
+// dropped. It is safe for concurrent use.
+func AddResponseHeader(ctx context.Context, key, value string) {
+	h, ok := ctx.Value(responseHeadersKey).(*responseHeaders)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.written {
+		return
+	}
+	for _, v := range h.header.Values(key) {
+		if v == value {
+			return
+		}
+	}
+	h.header.Add(key, value)
+}
+
+type responseHeaders struct {
+	mu      sync.Mutex
+	header  http.Header
+	written bool
+}
+
+// withResponseHeaders lets the APIs serving r add headers to the response,
+// which are copied to w when its headers are written.
+func withResponseHeaders(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	h := &responseHeaders{header: make(http.Header)}
+	ctx := context.WithValue(r.Context(), responseHeadersKey, h)
+	return &headerResponseWriter{ResponseWriter: w, headers: h}, r.WithContext(ctx)
+}
+
+type headerResponseWriter struct {
+	http.ResponseWriter
+	headers *responseHeaders
+}
+
+func (w *headerResponseWriter) writeHeaders() {
+	w.headers.mu.Lock()
+	defer w.headers.mu.Unlock()
+	if w.headers.written {
+		return
+	}
+	w.headers.written = true
+	for key, values := range w.headers.header {
+		for _, v := range values {
+			w.ResponseWriter.Header().Add(key, v)
+		}
+	}
+}
+
+func (w *headerResponseWriter) WriteHeader(code int) {
+	w.writeHeaders()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerResponseWriter) Write(p []byte) (int, error) {
+	w.writeHeaders()
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom exposes the underlying ResponseWriter to io.Copy.
+func (w *headerResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.writeHeaders()
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *headerResponseWriter) Flush() {
+	w.writeHeaders()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
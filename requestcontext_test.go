@@ -0,0 +1,28 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddResponseHeader(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w, r := withResponseHeaders(rec, httptest.NewRequest(http.MethodGet, "/ipfs/bafkqaaa", nil))
+
+	AddResponseHeader(r.Context(), "X-Ipfs-Backend", "local;not_found")
+	AddResponseHeader(r.Context(), "X-Ipfs-Backend", "remote")
+	AddResponseHeader(r.Context(), "X-Ipfs-Backend", "remote")
+	w.Write([]byte("hello"))
+	// too late
+	AddResponseHeader(r.Context(), "X-Ipfs-Backend", "archive")
+
+	got := rec.Result().Header.Values("X-Ipfs-Backend")
+	if len(got) != 2 || got[0] != "local;not_found" || got[1] != "remote" {
+		t.Fatalf("unexpected headers %v", got)
+	}
+
+	// outside of the gateway handler
+	AddResponseHeader(context.Background(), "X-Ipfs-Backend", "local")
+}
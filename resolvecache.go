@@ -0,0 +1,159 @@
+package gateway
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultResolveCacheSize is the number of resolved paths cached when
+// GatewayConfig.ResolveCacheSize is zero.
+const defaultResolveCacheSize = 4096
+
+// revalidateTimeout bounds the resolutions of stale cache entries.
+const revalidateTimeout = time.Minute
+
+// resolveCache keeps the most recently used resolutions of content paths.
+// Immutable paths are kept until evicted, mutable ones until the TTL of their
+// names passes, after which they are served stale while being resolved again
+// in the background.
+type resolveCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // of *resolveEntry, the most recently used first
+	entries map[string]*list.Element
+}
+
+type resolveEntry struct {
+	key          string
+	resolved     Resolved
+	expires      time.Time // zero for immutable paths
+	revalidating bool
+}
+
+// newResolveCache returns a cache of size entries. A zero size uses the
+// default, a negative one disables caching.
+func newResolveCache(size int) *resolveCache {
+	if size == 0 {
+		size = defaultResolveCacheSize
+	}
+	if size < 0 {
+		return nil
+	}
+	return &resolveCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the cached resolution of key, and whether it is stale. The
+// caller revalidating stale entries is the first one to get them.
+func (c *resolveCache) get(key string, now time.Time) (resolved Resolved, stale, revalidate bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	c.order.MoveToFront(elem)
+	e := elem.Value.(*resolveEntry)
+	if e.expires.IsZero() || now.Before(e.expires) {
+		return e.resolved, false, false
+	}
+	revalidate = !e.revalidating
+	e.revalidating = true
+	return e.resolved, true, revalidate
+}
+
+// add caches the resolution of key, until expires if it isn't zero.
+func (c *resolveCache) add(key string, resolved Resolved, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&resolveEntry{key: key, resolved: resolved, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resolveEntry).key)
+	}
+}
+
+// remove drops the resolution of key.
+func (c *resolveCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// resolvePath resolves the content path of r through the resolution cache.
+func (i *gatewayHandler) resolvePath(r *http.Request, contentPath Path) (Resolved, error) {
+	if i.resolutions == nil {
+		return ResolvePath(r.Context(), i.api, contentPath)
+	}
+	// the backends of the gateways may resolve paths differently
+	key := i.backend + "\x00" + contentPath.String()
+	ns := contentPath.Namespace()
+
+	resolved, stale, revalidate := i.resolutions.get(key, time.Now())
+	if resolved != nil {
+		i.resolveCacheHitMetric.WithLabelValues(ns).Inc()
+		if revalidate {
+			// without the deadline and cancellation of the request, which
+			// ends before the resolution, but stopping with the server
+			ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, revalidateTimeout)
+			go func() {
+				defer cancel()
+				if _, err := i.resolveAndCache(ctx, key, contentPath); err != nil {
+					log.Debugw("failed to revalidate resolution", "path", contentPath, "error", err)
+					i.resolutions.remove(key)
+				}
+			}()
+		}
+		if stale {
+			log.Debugw("serving stale resolution", "path", contentPath)
+		}
+		return resolved, nil
+	}
+	i.resolveCacheMissMetric.WithLabelValues(ns).Inc()
+	return i.resolveAndCache(r.Context(), key, contentPath)
+}
+
+func (i *gatewayHandler) resolveAndCache(ctx context.Context, key string, contentPath Path) (Resolved, error) {
+	resolved, ttl, err := resolvePathTTL(ctx, i.api, contentPath)
+	if err != nil {
+		return nil, err
+	}
+	var expires time.Time
+	if contentPath.Mutable() {
+		expires = time.Now().Add(ttl)
+	}
+	i.resolutions.add(key, resolved, expires)
+	return resolved, nil
+}
+
+// detachedContext keeps the values of a context, but not its deadline and
+// cancellation. It is done when the server handling the request the context
+// comes from shuts down, if any.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (c detachedContext) Done() <-chan struct{} {
+	return serverShutdown(c.Context)
+}
+
+func (c detachedContext) Err() error {
+	select {
+	case <-c.Done():
+		return context.Canceled
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,220 @@
+package gateway
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResolveCache(t *testing.T) {
+	c := newResolveCache(2)
+	now := time.Now()
+	a, b, d := IpfsPath(cid.Undef), IpfsPath(cid.Undef), IpfsPath(cid.Undef)
+
+	c.add("a", a, time.Time{})
+	c.add("b", b, now.Add(time.Minute))
+	if r, stale, _ := c.get("a", now); r != a || stale {
+		t.Fatal("expected a fresh a")
+	}
+	// b is the least recently used
+	c.add("d", d, time.Time{})
+	if r, _, _ := c.get("b", now); r != nil {
+		t.Fatal("expected b to be evicted")
+	}
+
+	c.add("b", b, now.Add(time.Minute))
+	if r, stale, _ := c.get("b", now.Add(time.Hour)); r != b || !stale {
+		t.Fatal("expected a stale b")
+	}
+	// revalidated by the first caller only
+	if _, _, revalidate := c.get("b", now.Add(time.Hour)); revalidate {
+		t.Fatal("expected b to be revalidated once")
+	}
+	c.remove("b")
+	if r, _, _ := c.get("b", now); r != nil {
+		t.Fatal("expected b to be removed")
+	}
+
+	if newResolveCache(-1) != nil {
+		t.Fatal("expected negative sizes to disable the cache")
+	}
+}
+
+// nameAPI resolves IPNS names with a TTL, and counts the resolutions.
+type nameAPI struct {
+	*latencyAPI
+	ttl time.Duration
+
+	mu          sync.Mutex
+	names       map[string]string
+	resolutions int
+}
+
+func (a *nameAPI) ResolveTTL(_ context.Context, name string) (string, time.Duration, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.resolutions++
+	if value, ok := a.names[name]; ok {
+		return value, a.ttl, nil
+	}
+	return "", 0, ErrNotFound
+}
+
+func (a *nameAPI) set(name, value string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.names[name] = value
+}
+
+func (a *nameAPI) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.resolutions
+}
+
+func TestResolveCacheHandler(t *testing.T) {
+	store := &memstore.Store{Bag: map[string][]byte{}}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+	dir := func(content string) cid.Cid {
+		lnk, size, err := builder.BuildUnixFSFile(strings.NewReader(content), "", &ls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := builder.BuildUnixFSDirectoryEntry("hello.txt", int64(size), lnk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, _, err := builder.BuildUnixFSDirectory([]dagpb.PBLink{entry}, &ls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root.(cidlink.Link).Cid
+	}
+	v1, v2 := dir("v1"), dir("v2")
+
+	a := &nameAPI{
+		latencyAPI: &latencyAPI{store: store},
+		ttl:        100 * time.Millisecond,
+		names:      map[string]string{"/ipns/example.com": "/ipfs/" + v1.String()},
+	}
+	snap, err := newConfigSnapshot(&GatewayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newGatewayHandler(snap, a)
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	get := func(path string) string {
+		t.Helper()
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", path, res.StatusCode, body)
+		}
+		return string(body)
+	}
+	hits := func(ns string) float64 { return testutil.ToFloat64(h.resolveCacheHitMetric.WithLabelValues(ns)) }
+	misses := func(ns string) float64 { return testutil.ToFloat64(h.resolveCacheMissMetric.WithLabelValues(ns)) }
+
+	// immutable paths are resolved once
+	hit, miss := hits("ipfs"), misses("ipfs")
+	for n := 0; n < 3; n++ {
+		if body := get("/ipfs/" + v1.String() + "/hello.txt"); body != "v1" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+	if hits("ipfs")-hit != 2 || misses("ipfs")-miss != 1 {
+		t.Fatalf("expected 2 hits and 1 miss, got %v and %v", hits("ipfs")-hit, misses("ipfs")-miss)
+	}
+
+	// names are resolved again once their TTL passes
+	for n := 0; n < 3; n++ {
+		if body := get("/ipns/example.com/hello.txt"); body != "v1" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	}
+	if a.count() != 1 {
+		t.Fatalf("expected a single resolution, got %d", a.count())
+	}
+	a.set("/ipns/example.com", "/ipfs/"+v2.String())
+	time.Sleep(a.ttl)
+
+	// the stale resolution is served while revalidating
+	if body := get("/ipns/example.com/hello.txt"); body != "v1" {
+		t.Fatalf("expected the stale resolution, got %q", body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for get("/ipns/example.com/hello.txt") != "v2" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the resolution to be revalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a.count() != 2 {
+		t.Fatalf("expected 2 resolutions, got %d", a.count())
+	}
+
+	// names which can't be resolved anymore are dropped
+	a.set("/ipns/example.com", "/ipns/example.com")
+	time.Sleep(a.ttl)
+	get("/ipns/example.com/hello.txt")
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get(ts.URL + "/ipns/example.com/hello.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the failed revalidation to drop the resolution")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDetachedContextEndsWithServer(t *testing.T) {
+	shutdown := make(chan struct{})
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), serverShutdownKey, (<-chan struct{})(shutdown)))
+	ctx, cancelDetached := context.WithTimeout(detachedContext{parent}, time.Minute)
+	defer cancelDetached()
+
+	// the request ending doesn't stop revalidations
+	cancel()
+	select {
+	case <-ctx.Done():
+		t.Fatal("expected the detached context to outlive its parent")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(shutdown)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the detached context to end on shutdown")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("unexpected error %v", ctx.Err())
+	}
+}
@@ -0,0 +1,387 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/gateway-prime/mock"
+	"github.com/ipfs/go-cid"
+	lwriter "github.com/ipfs/go-log/writer"
+	quickbuilder "github.com/ipfs/go-unixfsnode/data/builder/quick"
+	gocar "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"golang.org/x/net/http2"
+)
+
+func listenLocal(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestServeConstructionError(t *testing.T) {
+	failing := func(API, *GatewayConfig, net.Listener, *http.ServeMux) (*http.ServeMux, error) {
+		return nil, errors.New("bad option")
+	}
+	l := listenLocal(t)
+	defer l.Close()
+
+	s, err := Serve(&mock.API{}, &GatewayConfig{}, l, failing)
+	if err == nil || err.Error() != "bad option" {
+		t.Fatalf("expected construction error, got %v", err)
+	}
+	if s != nil {
+		t.Fatal("expected no server to be returned")
+	}
+}
+
+func TestServerGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slowOption := func(_ API, _ *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("done"))
+		})
+		return mux, nil
+	}
+
+	s, err := Serve(&mock.API{}, &GatewayConfig{}, listenLocal(t), slowOption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + s.Addrs()[0].String()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := http.Get(url + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown returned before the in-flight request finished: %v", err)
+	case <-s.Done():
+		t.Fatal("server reported done before the in-flight request finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// no new connections are accepted while draining
+	if _, err := http.Get(url + "/slow"); err == nil {
+		t.Fatal("expected new requests to fail during shutdown")
+	}
+
+	close(release)
+	if r := <-results; r.err != nil || r.body != "done" {
+		t.Fatalf("in-flight request was not completed: %q, %v", r.body, r.err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("expected server to be done after shutdown")
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("expected no error after a clean shutdown, got %s", err)
+	}
+}
+
+func TestServerShutdownEndsStreams(t *testing.T) {
+	s, err := Serve(&mock.API{}, &GatewayConfig{}, listenLocal(t), LogOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get("http://" + s.Addrs()[0].String() + "/logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("expected the log stream to end on shutdown, got %s", err)
+	}
+}
+
+// finishedWriter records writes made after the handler using it returned.
+type finishedWriter struct {
+	httptest.ResponseRecorder
+	finished int32
+	late     int32
+}
+
+func (w *finishedWriter) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&w.finished) == 1 {
+		atomic.AddInt32(&w.late, 1)
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestLogsAfterShutdown(t *testing.T) {
+	mux, err := LogOption()(&mock.API{}, &GatewayConfig{}, nil, http.NewServeMux())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan struct{})
+	close(shutdown)
+	ctx := context.WithValue(context.Background(), serverShutdownKey, (<-chan struct{})(shutdown))
+	req := httptest.NewRequest(http.MethodGet, "/logs", nil).WithContext(ctx)
+	w := &finishedWriter{ResponseRecorder: *httptest.NewRecorder()}
+	mux.ServeHTTP(w, req)
+	atomic.StoreInt32(&w.finished, 1)
+
+	for i := 0; i < 10; i++ {
+		lwriter.WriterGroup.Write([]byte("logged after shutdown\n"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&w.late); n != 0 {
+		t.Fatalf("expected no writes after the handler returned, got %d", n)
+	}
+}
+
+func TestServerListenerFailure(t *testing.T) {
+	l := listenLocal(t)
+	s, err := Serve(&mock.API{}, &GatewayConfig{}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the listener under the server makes Serve fail
+	l.Close()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after its listener failed")
+	}
+	if s.Err() == nil {
+		t.Fatal("expected the listener error to be reported")
+	}
+}
+
+// gatedAPI holds off loading one block until its gate is opened.
+type gatedAPI struct {
+	mock.API
+	block cid.Cid
+	gate  chan struct{}
+}
+
+func (g *gatedAPI) NewSession(ctx context.Context) *ipld.LinkSystem {
+	ls := *g.API.NewSession(ctx)
+	opener := ls.StorageReadOpener
+	ls.StorageReadOpener = func(lctx linking.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		if lnk.(cidlink.Link).Cid.Equals(g.block) {
+			select {
+			case <-g.gate:
+			case <-lctx.Ctx.Done():
+				return nil, lctx.Ctx.Err()
+			}
+		}
+		return opener(lctx, lnk)
+	}
+	return &ls
+}
+
+// h2cClient returns a client speaking HTTP/2 over cleartext with prior
+// knowledge.
+func h2cClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+}
+
+func TestServerShutdownDrainsH2C(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slowOption := func(_ API, _ *GatewayConfig, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			select {
+			case <-release:
+				w.Write([]byte("done"))
+			case <-r.Context().Done():
+			}
+		})
+		return mux, nil
+	}
+
+	for _, forced := range []bool{false, true} {
+		s, err := Serve(&mock.API{}, &GatewayConfig{H2C: true}, listenLocal(t), slowOption)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		type result struct {
+			body string
+			err  error
+		}
+		results := make(chan result, 1)
+		go func() {
+			res, err := h2cClient().Get("http://" + s.Addrs()[0].String() + "/slow")
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer res.Body.Close()
+			if res.ProtoMajor != 2 {
+				results <- result{err: errors.New("expected HTTP/2, got " + res.Proto)}
+				return
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			results <- result{string(body), err}
+		}()
+		<-started
+
+		ctx, cancel := context.WithCancel(context.Background())
+		shutdownErr := make(chan error, 1)
+		go func() { shutdownErr <- s.Shutdown(ctx) }()
+
+		select {
+		case err := <-shutdownErr:
+			t.Fatalf("shutdown returned before the in-flight h2c request finished: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if forced {
+			// the hijacked connection is closed once ctx expires
+			cancel()
+			if err := <-shutdownErr; err != context.Canceled {
+				t.Fatalf("expected shutdown to be cancelled, got %v", err)
+			}
+			if r := <-results; r.err == nil {
+				t.Fatalf("expected the h2c request to fail, got %q", r.body)
+			}
+			continue
+		}
+
+		release <- struct{}{}
+		if r := <-results; r.err != nil || r.body != "done" {
+			t.Fatalf("in-flight h2c request was not completed: %q, %v", r.body, r.err)
+		}
+		if err := <-shutdownErr; err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+	}
+}
+
+func TestH2CStreamsCAR(t *testing.T) {
+	a := &gatedAPI{gate: make(chan struct{})}
+	var root cid.Cid
+	if err := quickbuilder.Store(a.API.NewSession(context.Background()), func(b *quickbuilder.Builder) error {
+		slow := b.NewBytesFile([]byte("slow"))
+		a.block = slow.Link().(cidlink.Link).Cid
+		root = b.NewMapDirectory(map[string]quickbuilder.Node{
+			"fast": b.NewBytesFile([]byte("fast")),
+			"slow": slow,
+		}).Link().(cidlink.Link).Cid
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := makeHandler(a, &GatewayConfig{H2C: true}, nil, GatewayOption("/ipfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns int32
+	ts := httptest.NewUnstartedServer(h)
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	client := h2cClient()
+
+	res, err := client.Get(ts.URL + "/ipfs/" + root.String() + "?format=car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", res.Proto)
+	}
+
+	// the blocks loaded so far reach the client while the stream is stuck
+	// on the gated one
+	br, err := gocar.NewBlockReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := br.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blk.Cid().Equals(root) {
+		t.Fatalf("expected the root block first, got %s", blk.Cid())
+	}
+
+	// other requests are multiplexed over the same connection meanwhile
+	raw, err := client.Get(ts.URL + "/ipfs/" + root.String() + "?format=raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Body.Close()
+	if raw.StatusCode != http.StatusOK {
+		t.Fatalf("raw block request failed with %d", raw.StatusCode)
+	}
+
+	close(a.gate)
+	blocks := 1
+	for {
+		if _, err := br.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		blocks++
+	}
+	if blocks != 3 {
+		t.Fatalf("expected 3 blocks in the CAR, got %d", blocks)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("expected requests to share a single connection, got %d", n)
+	}
+}
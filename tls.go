@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certStore holds the TLS certificates of the PublicGateways and picks the
+// one matching the server name (SNI) of each TLS handshake. Certificates are
+// indexed by the DNS names they are valid for, so a single wildcard
+// certificate for *.ipfs.example.com serves every subdomain of a subdomain
+// gateway.
+type certStore struct {
+	pairs []TLSCertificate
+
+	mu       sync.RWMutex
+	byName   map[string]*tls.Certificate // lowercase DNS name or *.wildcard → cert
+	fallback *tls.Certificate
+}
+
+// newCertStore loads the certificates configured for all the PublicGateways.
+func newCertStore(gc *GatewayConfig) (*certStore, error) {
+	s := &certStore{}
+	seen := make(map[TLSCertificate]struct{})
+	for hostname, spec := range gc.PublicGateways {
+		if spec == nil {
+			continue
+		}
+		for _, pair := range spec.TLSCertificates {
+			if pair.CertFile == "" || pair.KeyFile == "" {
+				return nil, fmt.Errorf("public gateway %q: TLS certificate and key files must both be set", hostname)
+			}
+			if _, ok := seen[pair]; ok {
+				continue
+			}
+			seen[pair] = struct{}{}
+			s.pairs = append(s.pairs, pair)
+		}
+	}
+	if len(s.pairs) == 0 {
+		return nil, fmt.Errorf("no TLS certificates configured in PublicGateways")
+	}
+	// make the fallback certificate deterministic
+	sort.Slice(s.pairs, func(i, j int) bool {
+		if s.pairs[i].CertFile != s.pairs[j].CertFile {
+			return s.pairs[i].CertFile < s.pairs[j].CertFile
+		}
+		return s.pairs[i].KeyFile < s.pairs[j].KeyFile
+	})
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	for hostname, spec := range gc.PublicGateways {
+		if spec == nil || strings.Contains(hostname, "*") {
+			continue
+		}
+		names := []string{hostname}
+		if spec.UseSubdomains {
+			names = append(names, "example.ipfs."+hostname, "example.ipns."+hostname)
+		}
+		for _, name := range names {
+			if s.lookup(name) == nil {
+				log.Warnf("no TLS certificate matches %s, clients will get the default certificate", name)
+			}
+		}
+	}
+	return s, nil
+}
+
+// reload re-reads all certificate and key files. If any of them fails to
+// load, the previously loaded certificates are kept and an error is returned.
+func (s *certStore) reload() error {
+	byName := make(map[string]*tls.Certificate)
+	var fallback *tls.Certificate
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate %s: %w", pair.CertFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse TLS certificate %s: %w", pair.CertFile, err)
+		}
+		cert.Leaf = leaf
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// first configured certificate wins
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		if fallback == nil {
+			fallback = &cert
+		}
+	}
+
+	s.mu.Lock()
+	s.byName = byName
+	s.fallback = fallback
+	s.mu.Unlock()
+	return nil
+}
+
+// watch reloads the certificates whenever one of the files changes, checking
+// every interval. It blocks until ctx is done.
+func (s *certStore) watch(ctx context.Context, interval time.Duration) {
+	var paths []string
+	for _, pair := range s.pairs {
+		paths = append(paths, pair.CertFile, pair.KeyFile)
+	}
+	watchFiles(ctx, interval, func() {
+		if err := s.reload(); err != nil {
+			log.Errorf("failed to reload TLS certificates, keeping previous ones: %s", err)
+			return
+		}
+		log.Infof("reloaded TLS certificates")
+	}, paths...)
+}
+
+// lookup returns the certificate for the given server name, or nil if none
+// matches it. Wildcards only match a single label, as per RFC 6125.
+func (s *certStore) lookup(serverName string) *tls.Certificate {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if cert, ok := s.byName[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. Clients without SNI
+// or asking for an unknown name get the first configured certificate.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fallback, nil
+}
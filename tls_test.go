@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs-shipyard/gateway-prime/mock"
+)
+
+// writeTestCert writes a self-signed certificate valid for the given DNS
+// names, and its key, to dir/name.crt and dir/name.key.
+func writeTestCert(t *testing.T, dir, name string, dnsNames ...string) TLSCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := TLSCertificate{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	if err := ioutil.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	apex := writeTestCert(t, dir, "a-apex", "example.com")
+	wildcard := writeTestCert(t, dir, "b-wildcard", "*.ipfs.example.com", "*.ipns.example.com")
+
+	s, err := newCertStore(&GatewayConfig{
+		PublicGateways: map[string]*GatewaySpec{
+			"example.com": {UseSubdomains: true, TLSCertificates: []TLSCertificate{apex, wildcard}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certName := func(serverName string) string {
+		cert, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf.DNSNames[0]
+	}
+	for _, test := range []struct {
+		serverName string
+		out        string
+	}{
+		{"example.com", "example.com"},
+		{"EXAMPLE.com.", "example.com"},
+		{"bafkqaaa.ipfs.example.com", "*.ipfs.example.com"},
+		{"en-wikipedia--on--ipfs-org.ipns.example.com", "*.ipfs.example.com"},
+		// wildcards match a single label only
+		{"a.b.ipfs.example.com", "example.com"},
+		// no SNI, or unknown names, get the first certificate
+		{"", "example.com"},
+		{"other.net", "example.com"},
+	} {
+		if out := certName(test.serverName); out != test.out {
+			t.Errorf("certificate for %q: got %s, expected %s", test.serverName, out, test.out)
+		}
+	}
+
+	// rotate the apex certificate
+	writeTestCert(t, dir, "a-apex", "example.com", "www.example.com")
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if out := certName("www.example.com"); out != "example.com" {
+		t.Fatalf("expected the rotated certificate to be served, got %s", out)
+	}
+
+	// a broken certificate keeps the previous ones around
+	if err := ioutil.WriteFile(apex.CertFile, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reload(); err == nil {
+		t.Fatal("expected an error when reloading a broken certificate")
+	}
+	if out := certName("bafkqaaa.ipfs.example.com"); out != "*.ipfs.example.com" {
+		t.Fatalf("expected previous certificates to be kept, got %s", out)
+	}
+
+	if _, err := newCertStore(&GatewayConfig{}); err == nil {
+		t.Fatal("expected an error without any certificate")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	gc := &GatewayConfig{
+		PublicGateways: map[string]*GatewaySpec{
+			"example.com": {
+				Paths:         defaultPaths,
+				UseSubdomains: true,
+				TLSCertificates: []TLSCertificate{
+					writeTestCert(t, dir, "apex", "example.com"),
+					writeTestCert(t, dir, "wildcard", "*.ipfs.example.com", "*.ipns.example.com"),
+				},
+			},
+		},
+	}
+	s, err := ServeTLS(&mock.API{}, gc, listenLocal(t), HostnameOption(), GatewayOption("/ipfs", "/ipns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cid := "bafkqaaa"
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: "example.com", InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+s.Addrs()[0].String()+"/ipfs/"+cid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "example.com"
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if names := res.TLS.PeerCertificates[0].DNSNames; names[0] != "example.com" {
+		t.Fatalf("expected the apex certificate, got %v", names)
+	}
+	if loc := res.Header.Get("Location"); !strings.HasPrefix(loc, "https://"+cid+".ipfs.example.com/") {
+		t.Fatalf("expected redirect to the https subdomain, got %q", loc)
+	}
+}